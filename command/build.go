@@ -0,0 +1,46 @@
+package command
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	parse "github.com/ShinyTrinkets/spinal/parser"
+	util "github.com/ShinyTrinkets/spinal/util"
+)
+
+// build compiles a generated file, for the languages that need a build step.
+// The build is skipped if the artifact is newer than the generated file,
+// because the generated file is not touched when the code doesn't change.
+func build(lang parse.CodeType, file string, dir string, front parse.FrontMatter) error {
+	args, artifact, err := lang.BuildCmd(file, front)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return nil
+	}
+
+	src := filepath.Join(dir, file)
+	if !filepath.IsAbs(artifact) {
+		artifact = filepath.Join(dir, artifact)
+	}
+	_, srcTime, err := util.FileStats(src)
+	if err != nil {
+		return err
+	}
+	if _, outTime, err := util.FileStats(artifact); err == nil && !outTime.Before(srcTime) {
+		fmt.Printf("Build of '%s' is up to date\n", src)
+		return nil
+	}
+
+	fmt.Printf("Building '%s' ...\n", src)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
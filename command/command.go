@@ -1,14 +1,21 @@
 package command
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
+	ml "github.com/ShinyTrinkets/meta-logger"
 	ovr "github.com/ShinyTrinkets/overseer"
 	config "github.com/ShinyTrinkets/spinal/config"
 	srv "github.com/ShinyTrinkets/spinal/http"
+	"github.com/ShinyTrinkets/spinal/kvstore"
+	"github.com/ShinyTrinkets/spinal/limits"
 	parse "github.com/ShinyTrinkets/spinal/parser"
 	"github.com/ShinyTrinkets/spinal/state"
 )
@@ -18,12 +25,21 @@ type (
 	codeFile = parse.CodeFile
 )
 
+// How often to save the StateTree, when it changes
+const persistInterval = time.Second
+
+// How often to compact the KV tables, in file mode
+const compactInterval = time.Minute
+
 // SpinUp receives either a file or a folder, finds all valid source-files and runs them.
 // The call is blocked untill all procs finish, or
 // SIGINT or SIGTERM are sent to the parent process.
 // Force is enabled only for files, it can be dangerous for folders.
 // For dry run, the HTTP server and the Overseer will not run.
-func SpinUp(fname string, force bool, httpOpts string, noHTTP bool, dryRun bool) {
+// For watch mode, the source-files are reloaded when they change,
+// and the call is blocked until SIGINT or SIGTERM.
+// The procs are stopped before returning.
+func SpinUp(fname string, force bool, httpOpts string, noHTTP bool, dryRun bool, watch bool) {
 	var (
 		rootDir string
 		pairs   map[string]strToStr
@@ -40,6 +56,7 @@ func SpinUp(fname string, force bool, httpOpts string, noHTTP bool, dryRun bool)
 	// Overwrite HTTP options in case of dry-run
 	if dryRun {
 		noHTTP = true
+		watch = false
 	}
 	if noHTTP {
 		httpOpts = ""
@@ -60,6 +77,11 @@ func SpinUp(fname string, force bool, httpOpts string, noHTTP bool, dryRun bool)
 			fmt.Println("Unsafe mode enabled!")
 		}
 
+		if len(p.Needs) > 0 {
+			fmt.Println("The needs are ignored when running a single file.")
+			p.Needs = nil
+		}
+
 		fmt.Printf("Converting source file '%s' ...\n", fname)
 		rootDir = filepath.Dir(fname)
 		pairs = map[string]strToStr{p.Path: outFiles}
@@ -69,7 +91,11 @@ func SpinUp(fname string, force bool, httpOpts string, noHTTP bool, dryRun bool)
 		// is folder?
 		rootDir = strings.TrimRight(fname, "/")
 		fmt.Printf("Converting all source-files from '%s' ...\n", rootDir)
-		pairs, parsed, err = parse.ConvertFolder(rootDir)
+		var dropped map[string]error
+		pairs, parsed, dropped, err = parse.ConvertFolder(rootDir)
+		for path, err := range dropped {
+			fmt.Printf("Skipping '%s'! Error: %v\n", path, err)
+		}
 		if err != nil {
 			fmt.Printf("Cannot convert folder! Error: %v", err)
 			return
@@ -80,61 +106,73 @@ func SpinUp(fname string, force bool, httpOpts string, noHTTP bool, dryRun bool)
 		return
 	}
 
-	o := ovr.NewOverseer()
-
-	baseLen := len(rootDir) + 1
-	for inFile, convFiles := range pairs {
-		codeFile := parsed[inFile]
-		cwd := rootDir
-		if codeFile.Cwd != "" {
-			cwd = codeFile.Cwd
-		}
-
-		// Update StateTree LVL 1
-		state.SetLevel1(inFile,
-			&state.Header1{
-				Enabled: codeFile.Enabled,
-				ID:      codeFile.ID,
-				Db:      codeFile.Db,
-				Log:     codeFile.Log,
-				Cwd:     cwd,
-				Path:    codeFile.Path,
-				Ctime:   codeFile.Ctime,
-				Mtime:   codeFile.Mtime,
-			})
-		fmt.Println(state.GetLevel1(inFile))
-
-		for lang, outFile := range convFiles {
-			fmt.Printf("%s ==> %s\n", inFile, outFile)
-			if dryRun {
-				continue
-			}
+	// The recipes are started after the recipes they need
+	files := []codeFile{}
+	for _, p := range parsed {
+		files = append(files, p)
+	}
+	files, err = parse.SortRecipes(files)
+	if err != nil {
+		fmt.Printf("Cannot order source-files! Error: %v", err)
+		return
+	}
 
-			env := os.Environ()
-			env = append(env, "SPIN_ID="+codeFile.ID)
-			env = append(env, "SPIN_FILE="+outFile)
-			opts := ovr.Options{
-				Buffered: false, Streaming: true,
-				Group: inFile, Dir: cwd, Env: env,
-			}
-			if codeFile.DelayStart > 0 {
-				opts.DelayStart = codeFile.DelayStart
-			}
-			if codeFile.RetryTimes > 0 {
-				opts.RetryTimes = codeFile.RetryTimes
+	o := ovr.NewOverseer()
+	spin := newSpinner(o, rootDir, force, dryRun, watch)
+	spin.api = apiURL(httpOpts)
+	spin.secrets = newSecretStore(cfg.SecretsPath(), cfg.SecretsKeyFile)
+	// The secrets are decrypted once, if the recipes need them
+	for _, p := range files {
+		if len(p.Secrets) > 0 {
+			if _, err := spin.secrets.open(); err != nil {
+				fmt.Printf("Cannot open the secrets! Error: %v\n", err)
 			}
-
-			// Register the process with Overseer
-			exe := parse.CodeBlocks[lang].Executable
-			o.Add(outFile, exe, []string{outFile[baseLen:]}, opts)
+			break
 		}
 	}
+	limits.SetCgroupParent(cfg.CgroupDir)
+
+	// Capture the output of the procs into log files
+	spin.capture = newCapture(o, cfg.LogDir, cfg.LogExt, cfg.LogRotate)
+	ml.SetupLogBuilder(spin.capture.builder(ml.NewLogger))
 
 	if dryRun {
+		for _, p := range files {
+			spin.add(p, pairs[p.Path])
+		}
 		fmt.Println("\nSimulation over.")
 		return
 	}
 
+	// Restore the history of the recipes from the previous run,
+	// and save the StateTree when it changes
+	if fname := cfg.StatePath(); fname != "" {
+		spin.previous = loadPrevious(fname)
+		stop := state.Persist(fname, persistInterval, func(err error) {
+			fmt.Printf("Cannot save the state file! Error: %v\n", err)
+		})
+		defer stop()
+	}
+
+	// Bound the KV tables, before loading them
+	kvstore.SetDefaultLimits(cfg.KvLimits, cfg.KvTables)
+
+	// Load the KV tables saved before, and save the changes
+	if cfg.DbType == kvstore.TypeFile {
+		if err := kvstore.Open(filepath.Join(cfg.DbDir, "kv")); err != nil {
+			fmt.Printf("Cannot open the KV store! Error: %v\n", err)
+			return
+		}
+		kvstore.StartCompactor(compactInterval, func(err error) {
+			fmt.Printf("Cannot compact the KV store! Error: %v\n", err)
+		})
+		defer func() {
+			if err := kvstore.Close(); err != nil {
+				fmt.Printf("Cannot close the KV store! Error: %v\n", err)
+			}
+		}()
+	}
+
 	// Subscribe to state changes, for updating StateTree LVL 2
 	ch := make(chan *ovr.ProcessJSON)
 	o.WatchState(ch)
@@ -144,7 +182,8 @@ func SpinUp(fname string, force bool, httpOpts string, noHTTP bool, dryRun bool)
 			inFile := s.Group
 			outFile := s.ID
 			// fmt.Printf("> STATE CHANGED %s ==> %s\n", outFile, s.State)
-			state.SetLevel2(inFile, outFile, s)
+			// The recipe might have been removed in the mean time
+			state.SetLevel2IfExists(inFile, outFile, s)
 		}
 	}()
 
@@ -156,13 +195,68 @@ func SpinUp(fname string, force bool, httpOpts string, noHTTP bool, dryRun bool)
 		// Setup HTTP server
 		http := srv.NewServer(httpOpts)
 		// Activate Overseer endpoints
-		srv.OverseerEndpoint(http, o)
-		srv.LogsEndpoint(http, cfg)
+		srv.OverseerEndpoint(http, o, keeperID)
+		srv.LogsEndpoint(http, cfg, spin.capture.append)
 		srv.CacheEndpoint(http)
+		srv.QueueEndpoint(http)
+		srv.LocksEndpoint(http)
+		srv.EventsEndpoint(http)
 		srv.Serve(http)
 	}()
 
+	ctx, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stopSignals()
+
+	// The procs are registered and started after the Overseer is running
+	if !runOverseer(o) {
+		fmt.Println("Cannot start the Overseer!")
+		return
+	}
+	for _, p := range files {
+		spin.add(p, pairs[p.Path])
+	}
+	spin.start()
+	if watch {
+		go spin.watch(fname, m.IsDir())
+		fmt.Println("Watching source-files for changes...")
+	}
+
 	fmt.Println("Starting procs. Press Ctrl+C to stop...")
-	o.SuperviseAll()
+	// In watch mode, done is never closed
+	select {
+	case <-ctx.Done():
+	case <-spin.done:
+	}
+	spin.shutdown()
 	fmt.Println("\nShutdown.")
 }
+
+// loadPrevious reads the recipes saved by the previous run, by path
+func loadPrevious(fname string) map[string]state.Recipe {
+	previous := map[string]state.Recipe{}
+	tree, err := state.Load(fname)
+	if os.IsNotExist(err) {
+		return previous
+	}
+	if err != nil {
+		fmt.Printf("Cannot load the state file! Error: %v\n", err)
+		return previous
+	}
+	for _, r := range tree.Recipes {
+		previous[r.Path] = r
+	}
+	fmt.Printf("Restored the state of %d recipes\n", len(previous))
+	return previous
+}
+
+// apiURL returns the URL of the HTTP server, for the procs;
+// the host defaults to localhost, eg: ":8080"
+func apiURL(addr string) string {
+	if addr == "" {
+		return ""
+	}
+	if strings.HasPrefix(addr, ":") {
+		return "http://localhost" + addr
+	}
+	return "http://" + addr
+}
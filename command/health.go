@@ -0,0 +1,119 @@
+package command
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ShinyTrinkets/spinal/health"
+	"github.com/ShinyTrinkets/spinal/state"
+)
+
+// checkHealth runs the health checks of a recipe periodically,
+// until the procs are finished, or the recipe is removed.
+// The checks are skipped while the procs are not running.
+func (s *spinner) checkHealth(inFile string, r *recipe, done <-chan struct{}) {
+	h := r.front.Health
+	ticker := time.NewTicker(h.Every())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if !s.procsRunning(r) {
+			continue
+		}
+
+		cwd := state.GetLevel1(inFile).Cwd
+		err := health.Probe(h, r.front.ID, cwd)
+
+		var unhealthy, changed bool
+		var current state.HealthInfo
+		state.UpdateLevel1(inFile, func(h1 *state.Header1) {
+			info := h1.Health
+			if info == nil {
+				return
+			}
+			previous := info.Status
+			info.LastCheck = time.Now()
+			if err == nil {
+				info.Status = state.HealthOK
+				info.Failures = 0
+			} else {
+				info.Failures++
+				info.LastFailure = err.Error()
+				info.LastFailureAt = info.LastCheck
+				if info.Failures >= h.MaxFailures() {
+					info.Status = state.HealthUnhealthy
+					unhealthy = true
+				} else {
+					info.Status = state.HealthFailing
+				}
+			}
+			changed = info.Status != previous
+			current = *info
+		})
+
+		if changed {
+			state.Publish(state.Event{
+				Type: state.EventHealth, Recipe: inFile, ID: r.front.ID,
+				State: current.Status, Data: current,
+			})
+		}
+
+		if unhealthy && h.Restart {
+			fmt.Printf("Recipe '%s' is unhealthy: %v; restarting\n", inFile, err)
+			s.restartUnhealthy(inFile, r)
+		}
+	}
+}
+
+// procsRunning returns true if all the procs of the recipe are running
+func (s *spinner) procsRunning(r *recipe) bool {
+	if len(r.ids) == 0 {
+		return false
+	}
+	for _, id := range r.ids {
+		st := s.o.Status(id)
+		if st == nil || st.State != "running" {
+			return false
+		}
+	}
+	return true
+}
+
+// restartUnhealthy stops the procs of the recipe;
+// the supervisors restart them, because they are marked as unhealthy.
+func (s *spinner) restartUnhealthy(inFile string, r *recipe) {
+	s.Lock()
+	if r.unhealthy == nil {
+		r.unhealthy = map[string]bool{}
+	}
+	for _, id := range r.ids {
+		r.unhealthy[id] = true
+	}
+	s.Unlock()
+
+	state.UpdateLevel1(inFile, func(h *state.Header1) {
+		h.Health.Failures = 0
+	})
+	for _, id := range r.ids {
+		s.o.Stop(id)
+	}
+}
+
+// wasUnhealthy returns true, only once, if the proc was stopped
+// because the recipe was unhealthy
+func (s *spinner) wasUnhealthy(r *recipe, id string) bool {
+	s.Lock()
+	defer s.Unlock()
+	if r.unhealthy[id] {
+		delete(r.unhealthy, id)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,34 @@
+package command
+
+import (
+	"math"
+	"time"
+
+	ovr "github.com/ShinyTrinkets/overseer"
+)
+
+// The ID of the placeholder proc, hidden from the HTTP endpoints
+const keeperID = "spinal:keeper"
+
+// The start of the placeholder is delayed forever, so it never runs
+const keeperDelay = uint(math.MaxInt64 / int64(time.Millisecond))
+
+// runOverseer runs SuperviseAll in the background, until shutdown.
+// The Overseer streams the logs and the state changes only while
+// SuperviseAll is running, and SuperviseAll returns when its procs finish,
+// so it gets a placeholder proc that is never started: no process is created.
+// The recipe procs are supervised by the spinner, not by SuperviseAll.
+// Because of the placeholder, SuperviseAll never returns: SpinUp waits
+// for the spinner instead, and StopAll ends the streaming on shutdown.
+// Returns false if SuperviseAll didn't start.
+func runOverseer(o *ovr.Overseer) bool {
+	o.Add(keeperID, keeperID, ovr.Options{DelayStart: keeperDelay})
+	go o.SuperviseAll()
+	for i := 0; i < removeRetries; i++ {
+		if o.IsRunning() {
+			return true
+		}
+		time.Sleep(timeUnit)
+	}
+	return false
+}
@@ -0,0 +1,141 @@
+package command
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ShinyTrinkets/spinal/limits"
+	parse "github.com/ShinyTrinkets/spinal/parser"
+	"github.com/ShinyTrinkets/spinal/state"
+)
+
+// How long a proc can take to stop after the timeout, before it's killed
+const killDelay = 5 * time.Second
+
+// limit wraps the command of a proc, to apply the resource limits of the recipe,
+// and returns the limits info for the StateTree. The memory, the CPU and
+// the processes are limited with a cgroup; if the cgroups are not available,
+// the memory and the CPU are not limited, and are reported as unenforced.
+func (s *spinner) limit(r *recipe, id string, name string, exe string, args []string) (string, []string, *state.LimitsInfo) {
+	l := r.front.Limits
+	if l.IsEmpty() {
+		return exe, args, nil
+	}
+	info := &state.LimitsInfo{Memory: int64(l.Memory), CPU: l.CPU, Files: l.Files, Procs: l.Procs}
+	if l.Timeout > 0 {
+		info.Timeout = l.Timeout.String()
+	}
+	if !limits.Supported {
+		// Only the timeout is applied
+		info.CgroupError = limits.ErrUnsupported.Error()
+		info.Unenforced = unenforced(l, true)
+		return exe, args, info
+	}
+
+	rl := limits.Rlimits{Files: l.Files, Procs: l.Procs}
+	cgroup := ""
+	if l.Memory > 0 || l.CPU > 0 || l.Procs > 0 {
+		cg, err := limits.NewCgroup(name, limits.CgroupLimits{Memory: int64(l.Memory), CPU: l.CPU, Procs: l.Procs})
+		if err != nil {
+			info.CgroupError = err.Error()
+			if info.Unenforced = unenforced(l, false); len(info.Unenforced) > 0 {
+				fmt.Printf("Cannot use a cgroup for '%s', the %s limits are not applied! Error: %v\n",
+					id, strings.Join(info.Unenforced, ", "), err)
+			} else {
+				fmt.Printf("Cannot use a cgroup for '%s', applying only the rlimits! Error: %v\n", id, err)
+			}
+		} else {
+			cgroup = cg.Dir
+			info.Cgroup = cg.Dir
+			s.Lock()
+			r.cgroups[id] = cg
+			s.Unlock()
+		}
+	}
+	if rl.IsEmpty() && cgroup == "" {
+		return exe, args, info
+	}
+	exe, args = limits.Command(exe, args, rl, cgroup)
+	return exe, args, info
+}
+
+// unenforced returns the names of the limits that cannot be applied without a cgroup,
+// or without rlimits; the address space rlimit is not a substitute for the memory,
+// because the runtimes like Node.js, Go, or Java reserve much more than they use
+func unenforced(l *parse.Limits, rlimits bool) []string {
+	names := []string{}
+	if l.Memory > 0 {
+		names = append(names, "memory")
+	}
+	if l.CPU > 0 {
+		names = append(names, "cpu")
+	}
+	if rlimits && l.Files > 0 {
+		names = append(names, "files")
+	}
+	if rlimits && l.Procs > 0 {
+		names = append(names, "procs")
+	}
+	return names
+}
+
+// startTimeout stops the proc when the run takes longer than the timeout
+// of the recipe, and kills it if it doesn't stop.
+// Returns a function that cancels the timeout.
+func (s *spinner) startTimeout(r *recipe, id string) func() {
+	l := r.front.Limits
+	if l == nil || l.Timeout <= 0 {
+		return func() {}
+	}
+	// The delay before start is not counted
+	delay := time.Duration(r.front.DelayStart) * time.Millisecond
+	timer := time.AfterFunc(l.Timeout+delay, func() {
+		s.Lock()
+		if r.limited == nil {
+			r.limited = map[string]string{}
+		}
+		r.limited[id] = limits.ReasonTimeout
+		s.Unlock()
+
+		fmt.Printf("Proc '%s' timed out after %v; stopping\n", id, l.Timeout)
+		s.o.Stop(id)
+		time.AfterFunc(killDelay, func() {
+			s.Lock()
+			stopping := r.limited[id] != ""
+			s.Unlock()
+			// The Overseer can only send SIGTERM
+			if st := s.o.Status(id); stopping && st != nil && st.PID > 0 {
+				limits.Kill(st.PID)
+			}
+		})
+	})
+	return func() {
+		timer.Stop()
+	}
+}
+
+// limitReason returns, only once, the limit that killed the proc:
+// the timeout, or the memory, if the OOM killer of the cgroup was triggered
+func (s *spinner) limitReason(r *recipe, id string) string {
+	s.Lock()
+	defer s.Unlock()
+	reason := r.limited[id]
+	delete(r.limited, id)
+	if cg := r.cgroups[id]; cg != nil && cg.OOMKilled() && reason == "" {
+		reason = limits.ReasonMemory
+	}
+	return reason
+}
+
+// removeCgroups deletes the cgroups of the recipe; the procs must be stopped
+func (s *spinner) removeCgroups(r *recipe) {
+	s.Lock()
+	defer s.Unlock()
+	for id, cg := range r.cgroups {
+		if err := cg.Remove(); err != nil {
+			fmt.Printf("Cannot remove the cgroup of '%s'! Error: %v\n", id, err)
+		}
+		delete(r.cgroups, id)
+	}
+}
@@ -0,0 +1,156 @@
+package command
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	ml "github.com/ShinyTrinkets/meta-logger"
+	ovr "github.com/ShinyTrinkets/overseer"
+	"github.com/ShinyTrinkets/spinal/logs"
+	"github.com/ShinyTrinkets/spinal/secrets"
+)
+
+// The Overseer creates one logger for each proc, with this prefix
+const procLoggerPrefix = "cmd:"
+
+// capture writes the output of the procs into log files:
+// LogDir/<id>.log, or LogDir/<id>.<block>.log for named blocks.
+type capture struct {
+	sync.Mutex
+	o       *ovr.Overseer
+	dir     string
+	ext     string
+	opts    logs.Rotation
+	procs   map[string]*logs.Writer // proc ID => log writer
+	writers map[string]*logs.Writer // log name => log writer
+}
+
+func newCapture(o *ovr.Overseer, dir string, ext string, opts logs.Rotation) *capture {
+	return &capture{
+		o: o, dir: dir, ext: ext, opts: opts,
+		procs:   map[string]*logs.Writer{},
+		writers: map[string]*logs.Writer{},
+	}
+}
+
+// register links the output of a proc to a log file;
+// the blocks of the same recipe and name share the log file.
+func (c *capture) register(id string, name string) {
+	c.Lock()
+	defer c.Unlock()
+	w, exists := c.writers[name]
+	if !exists {
+		w = logs.NewWriter(filepath.Join(c.dir, name+c.ext), c.opts)
+		c.writers[name] = w
+	}
+	c.procs[id] = w
+}
+
+// unregister stops capturing the output of a proc
+func (c *capture) unregister(id string) {
+	c.Lock()
+	defer c.Unlock()
+	w, exists := c.procs[id]
+	if !exists {
+		return
+	}
+	delete(c.procs, id)
+	for _, other := range c.procs {
+		if other == w {
+			return
+		}
+	}
+	// The last proc using the log file
+	w.Close()
+	for name, other := range c.writers {
+		if other == w {
+			delete(c.writers, name)
+		}
+	}
+}
+
+// write appends one line of output from a proc
+func (c *capture) write(id string, stream string, line string) {
+	c.Lock()
+	w, exists := c.procs[id]
+	c.Unlock()
+	if !exists {
+		return
+	}
+	pid := 0
+	if st := c.o.Status(id); st != nil {
+		pid = st.PID
+	}
+	if err := w.Write(logs.NewEntry(stream, pid, line)); err != nil {
+		fmt.Printf("Cannot write log file '%s'! Error: %v\n", w.Path(), err)
+	}
+}
+
+// append writes one entry into a log file, eg: from the HTTP API,
+// sharing the writer, and the rotation, with the procs of the log
+func (c *capture) append(name string, e logs.Entry) error {
+	e.Msg = secrets.Redact(e.Msg)
+	c.Lock()
+	defer c.Unlock()
+	if w, exists := c.writers[name]; exists {
+		return w.Write(e)
+	}
+	w := logs.NewWriter(filepath.Join(c.dir, name+c.ext), c.opts)
+	defer w.Close()
+	return w.Write(e)
+}
+
+// builder wraps the log builder of the Overseer,
+// to capture the output of the procs
+func (c *capture) builder(next ml.LogBuilderType) ml.LogBuilderType {
+	return func(name string) ml.Logger {
+		var l ml.Logger
+		if next != nil {
+			l = next(name)
+		} else {
+			l = &ml.DefaultLogger{Name: name}
+		}
+		if !strings.HasPrefix(name, procLoggerPrefix) {
+			return l
+		}
+		return &procLogger{Logger: l, id: name[len(procLoggerPrefix):], c: c}
+	}
+}
+
+// procLogger is the logger of one proc
+type procLogger struct {
+	ml.Logger
+	id string
+	c  *capture
+}
+
+// isOutput returns true for the lines of the proc output, that the Overseer
+// logs as they are; the messages of the Overseer always have attributes
+func isOutput(v []interface{}) bool {
+	for _, arg := range v {
+		if _, ok := arg.(ml.Attrs); ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Info receives the STDOUT lines, and the Overseer messages
+func (l *procLogger) Info(msg string, v ...interface{}) {
+	if isOutput(v) {
+		msg = secrets.Redact(msg)
+		l.c.write(l.id, logs.Stdout, msg)
+	}
+	l.Logger.Info(msg, v...)
+}
+
+// Error receives the STDERR lines, and the Overseer messages
+func (l *procLogger) Error(msg string, v ...interface{}) {
+	if isOutput(v) {
+		msg = secrets.Redact(msg)
+		l.c.write(l.id, logs.Stderr, msg)
+	}
+	l.Logger.Error(msg, v...)
+}
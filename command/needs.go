@@ -0,0 +1,148 @@
+package command
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	parse "github.com/ShinyTrinkets/spinal/parser"
+	"github.com/ShinyTrinkets/spinal/state"
+)
+
+// waitNeeds blocks until the recipes needed by this recipe
+// satisfy their conditions.
+// Returns false if the recipe was removed, or if the needs can never
+// be satisfied, eg: a needed task failed; in watch mode, the needed
+// recipes can be fixed, so the recipe keeps waiting.
+func (s *spinner) waitNeeds(inFile string, r *recipe) bool {
+	if len(r.front.Needs) == 0 {
+		return true
+	}
+
+	needs := []string{}
+	for _, need := range r.front.Needs {
+		needs = append(needs, need.ID+" ("+need.Condition+")")
+	}
+	fmt.Printf("Recipe '%s' is waiting for: %s\n", inFile, strings.Join(needs, ", "))
+
+	for {
+		met, failed := s.needsMet(r)
+		if met {
+			return true
+		}
+		if failed != "" && !s.watching {
+			fmt.Printf("Recipe '%s' cannot start, needed recipe '%s' failed!\n", inFile, failed)
+			return false
+		}
+		if r.removed() || s.o.IsStopping() {
+			return false
+		}
+		time.Sleep(timeUnit)
+	}
+}
+
+// needsMet returns true if all the needed recipes satisfy their conditions,
+// or the ID of a needed recipe that will never satisfy its condition.
+func (s *spinner) needsMet(r *recipe) (bool, string) {
+	for _, need := range r.front.Needs {
+		inFile, dep := s.recipeByID(need.ID)
+		if dep == nil {
+			// The recipe might be added later, in watch mode
+			return false, need.ID
+		}
+		met, failed := conditionMet(inFile, dep, need.Condition)
+		if met && need.Condition == parse.NeedHealthy && dep.front.Health != nil {
+			met = state.HasLevel1(inFile) && state.GetLevel1(inFile).Health.Status == state.HealthOK
+		}
+		if failed {
+			return false, need.ID
+		}
+		if !met {
+			return false, ""
+		}
+	}
+	return true, ""
+}
+
+// conditionMet checks the condition for all the procs of a recipe,
+// and returns true if the condition is satisfied, or if it failed.
+func conditionMet(inFile string, dep *recipe, condition string) (met bool, failed bool) {
+	if len(dep.ids) == 0 {
+		// All the procs failed to build
+		return false, true
+	}
+	for _, id := range dep.ids {
+		if !state.HasLevel2(inFile, id) {
+			return false, false
+		}
+		h := state.GetLevel2(inFile, id)
+		switch condition {
+		case parse.NeedCompleted:
+			// A service that exited normally also finished OK
+			if h.Result == state.ResultCompleted || h.Result == state.ResultExited {
+				continue
+			}
+			if h.Result != "" && h.Result != state.ResultRestarting {
+				return false, true
+			}
+			return false, false
+		default:
+			// Without health checks, healthy is the same as started;
+			// the health checks are verified by the caller
+			switch h.State {
+			case "", "initial", "starting":
+				return false, false
+			case "fatal":
+				return false, h.Result != "" && h.Result != state.ResultRestarting
+			}
+		}
+	}
+	return true, false
+}
+
+// recipeByID finds a recipe by the ID from front matter
+func (s *spinner) recipeByID(id string) (string, *recipe) {
+	s.Lock()
+	defer s.Unlock()
+	for inFile, r := range s.recipes {
+		if r.front.ID == id {
+			return inFile, r
+		}
+	}
+	return "", nil
+}
+
+// checkNeeds validates the needs of a recipe that is reloaded,
+// against all the other recipes. The needed recipes that are not loaded
+// might be added later, so only the cycles and the ambiguous needs are rejected.
+func (s *spinner) checkNeeds(p codeFile) error {
+	files := []codeFile{p}
+	s.Lock()
+	for inFile, r := range s.recipes {
+		if inFile == p.Path {
+			continue
+		}
+		if r.front.ID == p.ID {
+			s.Unlock()
+			return fmt.Errorf("duplicate recipe ID '%s', already used by '%s'", p.ID, inFile)
+		}
+		files = append(files, codeFile{FrontMatter: r.front, Path: inFile})
+	}
+	s.Unlock()
+
+	loaded := map[string]bool{}
+	for _, f := range files {
+		loaded[f.ID] = true
+	}
+	for i, f := range files {
+		needs := parse.Needs{}
+		for _, need := range f.Needs {
+			if loaded[need.ID] {
+				needs = append(needs, need)
+			}
+		}
+		files[i].Needs = needs
+	}
+	_, err := parse.SortRecipes(files)
+	return err
+}
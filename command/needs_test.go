@@ -0,0 +1,58 @@
+package command
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	ovr "github.com/ShinyTrinkets/overseer"
+	"github.com/ShinyTrinkets/spinal/logs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReloadNeeds(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	o := ovr.NewOverseer()
+	s := newSpinner(o, dir, false, false, true)
+	s.capture = newCapture(o, dir, ".log", logs.Rotation{})
+	write := func(name string, front string) string {
+		path := filepath.Join(dir, name)
+		text := "---\nspinal: true\n" + front + "---\n```sh\necho " + name + "\n```\n"
+		assert.Nil(ioutil.WriteFile(path, []byte(text), 0644))
+		return path
+	}
+	loaded := func(path string) bool {
+		s.Lock()
+		defer s.Unlock()
+		_, exists := s.recipes[path]
+		return exists
+	}
+
+	// In watch mode, the dependency can be added after the dependent recipe
+	app := write("app.md", "id: app\nneeds: [db]\n")
+	s.reload(app)
+	assert.True(loaded(app))
+	met, failed := s.needsMet(s.recipes[app])
+	assert.False(met)
+	assert.Equal("db", failed)
+
+	db := write("db.md", "id: db\n")
+	s.reload(db)
+	assert.True(loaded(db))
+	met, failed = s.needsMet(s.recipes[app])
+	assert.False(met)
+	assert.Equal("", failed)
+
+	// The cycles and the duplicate IDs are rejected
+	db = write("db.md", "id: db\nneeds: [app]\n")
+	s.reload(db)
+	assert.False(loaded(db))
+	dup := write("dup.md", "id: app\n")
+	s.reload(dup)
+	assert.False(loaded(dup))
+	assert.Nil(s.checkNeeds(codeFile{FrontMatter: s.recipes[app].front, Path: app}))
+
+	s.remove(app)
+	assert.False(loaded(app))
+}
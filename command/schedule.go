@@ -0,0 +1,113 @@
+package command
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	parse "github.com/ShinyTrinkets/spinal/parser"
+	"github.com/ShinyTrinkets/spinal/state"
+)
+
+// runSchedule launches the procs of a recipe as one-shot jobs,
+// at every tick of the schedule, until the recipe is removed.
+func (s *spinner) runSchedule(inFile string, r *recipe) {
+	for {
+		next := r.schedule.Next(time.Now())
+		if next.IsZero() {
+			fmt.Printf("The schedule of '%s' will never fire!\n", inFile)
+			return
+		}
+		state.UpdateLevel1(inFile, func(h *state.Header1) {
+			h.Schedule.NextRun = next
+		})
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-r.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		s.tick(inFile, r)
+	}
+}
+
+// tick starts a scheduled run of the recipe; if the previous run
+// is still in progress, the overlap policy of the recipe is applied.
+func (s *spinner) tick(inFile string, r *recipe) {
+	s.Lock()
+	busy := r.busy
+	if !busy {
+		r.busy = true
+	} else if r.front.Overlap == parse.OverlapQueue {
+		r.queued = true
+	}
+	s.Unlock()
+
+	if !busy {
+		go s.runJob(inFile, r)
+		return
+	}
+
+	switch r.front.Overlap {
+	case parse.OverlapQueue:
+		fmt.Printf("Scheduled run of '%s' is queued\n", inFile)
+	case parse.OverlapKill:
+		fmt.Printf("Scheduled run of '%s' kills the previous run\n", inFile)
+		for _, id := range r.ids {
+			s.o.Stop(id)
+		}
+		// Wait for the previous run to finish
+		for i := 0; i < removeRetries; i++ {
+			s.Lock()
+			busy = r.busy
+			if !busy {
+				r.busy = true
+			}
+			s.Unlock()
+			if !busy {
+				go s.runJob(inFile, r)
+				return
+			}
+			time.Sleep(timeUnit)
+		}
+		fmt.Printf("Cannot stop the previous run of '%s'!\n", inFile)
+	default:
+		fmt.Printf("Scheduled run of '%s' is skipped, the previous run is still running\n", inFile)
+		state.UpdateLevel1(inFile, func(h *state.Header1) {
+			h.Schedule.Skipped++
+		})
+	}
+}
+
+// runJob runs all the procs of a recipe once, and waits for them to finish.
+// If another run was queued meanwhile, the procs are run again.
+func (s *spinner) runJob(inFile string, r *recipe) {
+	for {
+		now := time.Now()
+		state.UpdateLevel1(inFile, func(h *state.Header1) {
+			h.Schedule.LastRun = now
+			h.Schedule.Runs++
+		})
+
+		var wg sync.WaitGroup
+		for _, id := range r.ids {
+			wg.Add(1)
+			go func(id string) {
+				defer wg.Done()
+				s.supervise(inFile, r, id)
+			}(id)
+		}
+		wg.Wait()
+
+		s.Lock()
+		again := r.queued && !r.removed()
+		r.queued = false
+		r.busy = again
+		s.Unlock()
+		if !again {
+			return
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package command
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ShinyTrinkets/spinal/secrets"
+)
+
+// secretStore keeps the decrypted secrets, opened once;
+// the store is opened again only when the secrets file, or the key file, change
+type secretStore struct {
+	sync.Mutex
+	file    string
+	keyFile string
+	store   *secrets.Store
+	err     error
+	mtimes  [2]time.Time // of the secrets file, and of the key file
+}
+
+func newSecretStore(file string, keyFile string) *secretStore {
+	return &secretStore{file: file, keyFile: keyFile}
+}
+
+// open returns the store, decrypting the file only if it changed
+func (ss *secretStore) open() (*secrets.Store, error) {
+	ss.Lock()
+	defer ss.Unlock()
+	mtimes := [2]time.Time{modTime(ss.file), modTime(ss.keyFile)}
+	if (ss.store != nil || ss.err != nil) && mtimes == ss.mtimes {
+		return ss.store, ss.err
+	}
+	ss.store, ss.err = secrets.Open(ss.file, ss.keyFile)
+	ss.mtimes = mtimes
+	return ss.store, ss.err
+}
+
+// modTime returns the last change of a file, or zero if it's missing
+func modTime(fname string) time.Time {
+	if fname == "" {
+		return time.Time{}
+	}
+	info, err := os.Stat(fname)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// secretEnv returns the secrets of a recipe, as env vars;
+// the changed secrets are used when the recipe is reloaded.
+// The values are registered, to be redacted from the logs and the state.
+func (s *spinner) secretEnv(names []string) ([]string, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	store, err := s.secrets.open()
+	if err != nil {
+		return nil, err
+	}
+	env := []string{}
+	for _, name := range names {
+		value, ok := store.Get(name)
+		if !ok {
+			return nil, fmt.Errorf("missing secret '%s'", name)
+		}
+		secrets.Register(value)
+		env = append(env, name+"="+value)
+	}
+	return env, nil
+}
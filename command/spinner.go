@@ -0,0 +1,406 @@
+package command
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	ovr "github.com/ShinyTrinkets/overseer"
+	"github.com/ShinyTrinkets/spinal/limits"
+	parse "github.com/ShinyTrinkets/spinal/parser"
+	"github.com/ShinyTrinkets/spinal/schedule"
+	"github.com/ShinyTrinkets/spinal/state"
+)
+
+// Tick time unit, used when waiting for the procs to stop
+const timeUnit = 100 * time.Millisecond
+
+// How many ticks to wait for a proc to stop, before giving up
+const removeRetries = 50
+
+// spinner keeps track of the procs registered with the Overseer,
+// for each recipe, so they can be started, reloaded, or removed while running.
+type spinner struct {
+	sync.Mutex
+	o        *ovr.Overseer
+	rootDir  string
+	force    bool
+	dryRun   bool
+	watching bool
+	api      string             // the URL of the HTTP server, for the procs
+	running  bool               // true after the procs were started
+	closing  bool               // true after the shutdown started
+	recipes  map[string]*recipe // recipe path => recipe
+	order    []string           // recipe paths, in the order they were added
+	capture  *capture           // the output of the procs
+	active   sync.WaitGroup     // procs and schedules still running
+	done     chan struct{}      // closed when all the procs are finished
+	// The recipes saved by the previous Spinal run, restored when added
+	previous map[string]state.Recipe
+	// The encrypted secrets of the recipes
+	secrets *secretStore
+}
+
+// recipe represents the procs registered for one source-file
+type recipe struct {
+	front    parse.FrontMatter
+	ids      []string
+	schedule schedule.Schedule // nil, if the procs are not scheduled
+	stop     chan struct{}     // closed when the recipe is removed
+	busy     bool              // a scheduled run is in progress
+	queued   bool              // another scheduled run is waiting
+	// procs stopped by the health checks, that must be restarted
+	unhealthy map[string]bool
+	// procs killed by a resource limit, with the limit
+	limited map[string]string
+	// the cgroups of the procs with resource limits
+	cgroups map[string]*limits.Cgroup
+}
+
+func newSpinner(o *ovr.Overseer, rootDir string, force bool, dryRun bool, watch bool) *spinner {
+	return &spinner{
+		o:        o,
+		rootDir:  rootDir,
+		force:    force,
+		dryRun:   dryRun,
+		watching: watch,
+		recipes:  map[string]*recipe{},
+		done:     make(chan struct{}),
+	}
+}
+
+// add registers the procs of one recipe, and publishes the event
+func (s *spinner) add(codeFile codeFile, convFiles strToStr) {
+	s.register(codeFile, convFiles)
+	state.PublishRecipe(state.EventRecipeAdded, codeFile.Path, codeFile.ID)
+}
+
+// remove un-registers the procs of one recipe, and publishes the event
+func (s *spinner) remove(inFile string) {
+	if id, exists := s.unregister(inFile); exists {
+		state.Publish(state.Event{Type: state.EventRecipeRemoved, Recipe: inFile, ID: id})
+	}
+}
+
+// register updates the StateTree and registers the procs of one recipe.
+// If the procs were already started, the new procs are started immediately.
+func (s *spinner) register(codeFile codeFile, convFiles strToStr) {
+	inFile := codeFile.Path
+	cwd := s.rootDir
+	if codeFile.Cwd != "" {
+		cwd = codeFile.Cwd
+	}
+
+	header := &state.Header1{
+		Enabled: codeFile.Enabled,
+		ID:      codeFile.ID,
+		Db:      codeFile.Db,
+		Log:     codeFile.Log,
+		Cwd:     cwd,
+		Path:    codeFile.Path,
+		Ctime:   codeFile.Ctime,
+		Mtime:   codeFile.Mtime,
+		Kind:    codeFile.ProcKind(),
+		Restart: codeFile.RestartPolicy(),
+	}
+
+	r := &recipe{front: codeFile.FrontMatter, stop: make(chan struct{}),
+		cgroups: map[string]*limits.Cgroup{}}
+	if codeFile.Schedule != "" {
+		// The schedule was validated on conversion
+		r.schedule, _ = schedule.Parse(codeFile.Schedule)
+		overlap := codeFile.Overlap
+		if overlap == "" {
+			overlap = parse.OverlapSkip
+		}
+		header.Schedule = &state.ScheduleInfo{
+			Expr:    codeFile.Schedule,
+			Overlap: overlap,
+			NextRun: r.schedule.Next(time.Now()),
+		}
+	}
+	if codeFile.Health != nil {
+		header.Health = &state.HealthInfo{Status: state.HealthUnknown}
+	}
+	prev, restored := s.restored(inFile)
+	if restored {
+		header.Restore(prev)
+	}
+
+	baseLen := len(s.rootDir) + 1
+	baseEnv, envErr := codeFile.ProcEnv(inFile)
+	if envErr == nil {
+		var secretEnv []string
+		secretEnv, envErr = s.secretEnv(codeFile.Secrets)
+		baseEnv = append(baseEnv, secretEnv...)
+	}
+	if envErr != nil {
+		fmt.Printf("Cannot setup the env of '%s'! Error: %v\n", inFile, envErr)
+	}
+
+	for key, outFile := range convFiles {
+		fmt.Printf("%s ==> %s\n", inFile, outFile)
+		if s.dryRun {
+			continue
+		}
+		if envErr != nil {
+			header.SetError(key, envErr)
+			continue
+		}
+
+		// The blocks of the same recipe and name share the log file
+		logName := codeFile.ID
+		if name := codeFile.Blocks[key].Name; name != "" {
+			logName += "." + name
+		}
+
+		env := append([]string{}, baseEnv...)
+		env = append(env, "SPIN_ID="+codeFile.ID)
+		env = append(env, "SPIN_FILE="+outFile)
+		env = append(env, "SPIN_LOG="+logName)
+		if s.api != "" {
+			env = append(env, "SPIN_API="+s.api)
+		}
+		opts := ovr.Options{
+			Buffered: false, Streaming: true,
+			Group: inFile, Dir: cwd, Env: env,
+		}
+		if codeFile.DelayStart > 0 {
+			opts.DelayStart = codeFile.DelayStart
+		}
+		// The restarts are managed by the spinner, not by the Overseer
+
+		// Compile the file, if the language needs it;
+		// a broken build is not started
+		lang := parse.CodeBlocks[codeFile.Blocks[key].Lang]
+		if err := build(lang, outFile[baseLen:], cwd, codeFile.FrontMatter); err != nil {
+			fmt.Printf("Cannot build '%s'! Error: %v\n", outFile, err)
+			header.SetError(key, err)
+			continue
+		}
+
+		// Register the process with Overseer
+		exe, args, err := lang.Cmd(outFile[baseLen:], codeFile.FrontMatter)
+		if err != nil {
+			fmt.Printf("Cannot build %s command! Error: %v\n", lang.Name, err)
+			header.SetError(key, err)
+			continue
+		}
+		// Apply the resource limits, with a wrapper
+		exe, args, limitsInfo := s.limit(r, outFile, limits.CgroupName(codeFile.ID, key), exe, args)
+		if s.o.Add(outFile, exe, args, opts) != nil {
+			r.ids = append(r.ids, outFile)
+			s.capture.register(outFile, logName)
+			state.UpdateLevel2(inFile, outFile, func(h *state.Header2) {
+				h.Limits = limitsInfo
+				if p, exists := prev.FindProc(outFile); restored && exists {
+					h.Restore(p)
+				}
+				h.Kind = header.Kind
+				h.Restart = header.Restart
+			})
+		}
+	}
+
+	// Update StateTree LVL 1
+	state.SetLevel1(inFile, header)
+	fmt.Println(state.GetLevel1(inFile))
+
+	if s.dryRun {
+		return
+	}
+
+	s.Lock()
+	s.recipes[inFile] = r
+	s.order = append(s.order, inFile)
+	running := s.running
+	s.Unlock()
+
+	if running {
+		s.launch(inFile, r)
+	}
+}
+
+// unregister stops and un-registers all the procs of one recipe,
+// and removes the recipe from the StateTree.
+// Returns the ID of the recipe, if it existed.
+func (s *spinner) unregister(inFile string) (string, bool) {
+	s.Lock()
+	r, exists := s.recipes[inFile]
+	delete(s.recipes, inFile)
+	for i, path := range s.order {
+		if path == inFile {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+	s.Unlock()
+	if !exists {
+		return "", false
+	}
+
+	close(r.stop)
+	for _, id := range r.ids {
+		s.o.Stop(id)
+		// The proc can be removed only after it stopped
+		for i := 0; i < removeRetries && !s.o.Remove(id); i++ {
+			time.Sleep(timeUnit)
+		}
+		s.capture.unregister(id)
+	}
+	s.removeCgroups(r)
+	state.DelLevel1(inFile)
+	return r.front.ID, true
+}
+
+// reload parses and converts one recipe again,
+// and replaces its procs with the new ones.
+// If the recipe cannot be converted anymore, its procs are removed.
+func (s *spinner) reload(inFile string) {
+	p := parse.ParseFile(inFile)
+	outFiles, err := parse.ConvertFile(p, s.force)
+	if err == nil {
+		err = s.checkNeeds(p)
+	}
+
+	s.Lock()
+	_, exists := s.recipes[inFile]
+	s.Unlock()
+
+	if err != nil {
+		if exists {
+			fmt.Printf("Removing source file '%s' ... %v\n", inFile, err)
+			s.remove(inFile)
+		}
+		return
+	}
+
+	if !exists {
+		s.add(p, outFiles)
+		return
+	}
+	fmt.Printf("Reloading source file '%s' ...\n", inFile)
+	s.unregister(inFile)
+	s.register(p, outFiles)
+	state.PublishRecipe(state.EventRecipeReloaded, p.Path, p.ID)
+}
+
+// start launches the procs of all the recipes, in the order they were added;
+// from now on, all the new procs are started when added.
+// The Overseer must be running before calling start.
+// Outside of watch mode, done is closed when all procs
+// and schedules are finished, so SpinUp can return.
+func (s *spinner) start() {
+	s.Lock()
+	s.running = true
+	order := append([]string{}, s.order...)
+	recipes := map[string]*recipe{}
+	for inFile, r := range s.recipes {
+		recipes[inFile] = r
+	}
+	s.Unlock()
+
+	for _, inFile := range order {
+		s.launch(inFile, recipes[inFile])
+	}
+
+	if !s.watching {
+		go func() {
+			s.active.Wait()
+			close(s.done)
+		}()
+	}
+}
+
+// launch waits for the needed recipes, then supervises the procs
+// of one recipe and runs the health checks,
+// or starts the schedule for scheduled recipes.
+// After the shutdown started, the recipe is not launched.
+func (s *spinner) launch(inFile string, r *recipe) {
+	s.Lock()
+	if s.closing {
+		s.Unlock()
+		return
+	}
+	s.active.Add(1)
+	s.Unlock()
+	go func() {
+		defer s.active.Done()
+		if !s.waitNeeds(inFile, r) {
+			return
+		}
+		if r.schedule != nil {
+			s.runSchedule(inFile, r)
+			return
+		}
+		done := make(chan struct{})
+		if r.front.Health != nil {
+			go s.checkHealth(inFile, r, done)
+		}
+		var wg sync.WaitGroup
+		for _, id := range r.ids {
+			wg.Add(1)
+			go func(id string) {
+				defer wg.Done()
+				s.supervise(inFile, r, id)
+			}(id)
+		}
+		wg.Wait()
+		close(done)
+	}()
+}
+
+// shutdown stops all the procs, waits a while for the supervisors
+// to finish, then deletes the cgroups of all the recipes,
+// and undoes the changes in the parent cgroup
+func (s *spinner) shutdown() {
+	// No procs are launched while waiting for the others
+	s.Lock()
+	s.closing = true
+	s.Unlock()
+
+	s.o.StopAll(false)
+	finished := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(finished)
+	}()
+	// The schedules run until the recipes are removed
+	select {
+	case <-finished:
+	case <-time.After(removeRetries * timeUnit):
+	}
+
+	s.Lock()
+	recipes := []*recipe{}
+	for _, r := range s.recipes {
+		recipes = append(recipes, r)
+	}
+	s.Unlock()
+	for _, r := range recipes {
+		s.removeCgroups(r)
+	}
+	if err := limits.CgroupCleanup(); err != nil {
+		fmt.Printf("Cannot clean up the cgroups! Error: %v\n", err)
+	}
+}
+
+// restored returns the previous state of a recipe, only once;
+// the recipes reloaded later start from a clean state
+func (s *spinner) restored(inFile string) (state.Recipe, bool) {
+	s.Lock()
+	defer s.Unlock()
+	prev, exists := s.previous[inFile]
+	delete(s.previous, inFile)
+	return prev, exists
+}
+
+// removed returns true if the recipe was removed
+func (r *recipe) removed() bool {
+	select {
+	case <-r.stop:
+		return true
+	default:
+		return false
+	}
+}
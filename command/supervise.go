@@ -0,0 +1,100 @@
+package command
+
+import (
+	"fmt"
+	"time"
+
+	parse "github.com/ShinyTrinkets/spinal/parser"
+	"github.com/ShinyTrinkets/spinal/state"
+)
+
+// supervise runs one proc of a recipe, and restarts it when it exits,
+// according to the restart policy and the backoff of the recipe.
+// The Overseer runs the proc only once, the restarts are managed here.
+func (s *spinner) supervise(inFile string, r *recipe, id string) {
+	policy := r.front.RestartPolicy()
+	kind := r.front.ProcKind()
+	var restarts uint
+
+	for {
+		cancelTimeout := s.startTimeout(r, id)
+		s.o.Supervise(id)
+		cancelTimeout()
+		limit := s.limitReason(r, id)
+		if r.removed() || s.o.IsStopping() || !s.o.HasProc(id) {
+			return
+		}
+
+		st := s.o.Status(id)
+		failed := st.ExitCode != 0 || st.Error != nil
+		result := state.ResultFailed
+		unhealthy := false
+		if limit != "" {
+			// Killed by a resource limit, restarted as a failure
+			result = state.ResultLimited
+			failed = true
+		} else if st.State == "interrupted" && s.wasUnhealthy(r, id) {
+			// Stopped by the health checks, always restart
+			result = state.ResultUnhealthy
+			unhealthy = true
+		} else if st.State == "interrupted" {
+			// Stopped by the user, don't restart
+			result = state.ResultStopped
+			policy = parse.RestartNever
+		} else if !failed && kind == parse.KindTask {
+			result = state.ResultCompleted
+		} else if !failed {
+			result = state.ResultExited
+		}
+
+		exit := &state.ExitInfo{Code: st.ExitCode, Time: time.Now(), Limit: limit}
+		if st.Error != nil {
+			exit.Error = st.Error.Error()
+		}
+		if limit != "" {
+			fmt.Printf("Proc '%s' was killed by the %s limit\n", id, limit)
+			state.UpdateLevel2(inFile, id, func(h *state.Header2) {
+				if h.Limits != nil {
+					info := *h.Limits
+					info.Kills++
+					h.Limits = &info
+				}
+			})
+		}
+
+		restart := unhealthy || policy == parse.RestartAlways ||
+			(policy == parse.RestartOnFailure && failed)
+		// RetryTimes limits the number of restarts
+		if r.front.RetryTimes > 0 && restarts >= r.front.RetryTimes {
+			restart = false
+		}
+		if !restart {
+			state.UpdateLevel2(inFile, id, func(h *state.Header2) {
+				h.Result = result
+				h.LastExit = exit
+			})
+			return
+		}
+
+		delay := r.front.Backoff.Duration(restarts)
+		restarts++
+		fmt.Printf("Proc '%s' %s; restarting in %v [%d]\n", id, result, delay, restarts)
+		state.UpdateLevel2(inFile, id, func(h *state.Header2) {
+			h.Result = state.ResultRestarting
+			h.LastExit = exit
+			// The restarts from before a Spinal restart are counted
+			h.Restarts++
+		})
+		state.UpdateLevel1(inFile, func(h *state.Header1) {
+			h.Restarts++
+		})
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-r.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package command
+
+import (
+	"fmt"
+	"time"
+
+	parse "github.com/ShinyTrinkets/spinal/parser"
+	util "github.com/ShinyTrinkets/spinal/util"
+)
+
+// How often to check the source files for changes
+const watchInterval = time.Second
+
+// scanFiles returns the modification times of the source-files,
+// either of a single file, or of all the candidate files from a folder.
+func scanFiles(fname string, isDir bool) (map[string]time.Time, error) {
+	if isDir {
+		return parse.ScanFolder(fname)
+	}
+	files := map[string]time.Time{}
+	_, mtime, err := util.FileStats(fname)
+	if err == nil {
+		files[fname] = mtime
+	}
+	return files, nil
+}
+
+// watch polls the source-files for changes, reloads the recipes
+// that were created or changed, and removes the recipes that were deleted.
+// The call is blocked until the Overseer is stopping.
+func (s *spinner) watch(fname string, isDir bool) {
+	files, _ := scanFiles(fname, isDir)
+
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if s.o.IsStopping() {
+			return
+		}
+		latest, err := scanFiles(fname, isDir)
+		if err != nil {
+			// Maybe the folder is not accessible at the moment
+			continue
+		}
+		for path, mtime := range latest {
+			if old, ok := files[path]; !ok || !old.Equal(mtime) {
+				s.reload(path)
+			}
+		}
+		for path := range files {
+			if _, ok := latest[path]; !ok {
+				fmt.Printf("Removing deleted source file '%s' ...\n", path)
+				s.remove(path)
+			}
+		}
+		files = latest
+	}
+}
@@ -3,8 +3,12 @@ package config
 import (
 	"fmt"
 	"io/ioutil"
+	"path/filepath"
 	"strings"
 
+	"github.com/ShinyTrinkets/spinal/kvstore"
+	"github.com/ShinyTrinkets/spinal/logs"
+	parse "github.com/ShinyTrinkets/spinal/parser"
 	yml "gopkg.in/yaml.v3"
 )
 
@@ -12,12 +16,37 @@ type SpinalConfig struct {
 	LogDir string `yaml:"log_dir,omitempty" json:"log_dir,omitempty"`
 	LogExt string `yaml:"log_ext,omitempty" json:"log_ext,omitempty"`
 	DbDir  string `yaml:"db_dir,omitempty"  json:"db_dir,omitempty"`
-	// DbType string `yaml:"db_type,omitempty"  json:"db_type,omitempty"`
+	// The KV store type: memory, or file (saved under the DbDir)
+	DbType string `yaml:"db_type,omitempty"  json:"db_type,omitempty"`
+
+	// The limits of all the KV tables, and of specific tables, by name
+	KvLimits kvstore.Limits            `yaml:"kv_limits,omitempty" json:"kv_limits,omitempty"`
+	KvTables map[string]kvstore.Limits `yaml:"kv_tables,omitempty" json:"kv_tables,omitempty"`
+
+	// The StateTree is saved in this file, under the DbDir,
+	// and restored on the next run; empty to disable
+	StateFile string `yaml:"state_file,omitempty" json:"state_file,omitempty"`
+
+	// The encrypted secrets, under the DbDir, and the file with the key;
+	// the key can be defined in the SPIN_SECRET_KEY env var instead
+	SecretsFile    string `yaml:"secrets_file,omitempty" json:"secrets_file,omitempty"`
+	SecretsKeyFile string `yaml:"secrets_key_file,omitempty" json:"secrets_key_file,omitempty"`
+
+	// The parent cgroup v2 of the procs with resource limits, delegated to Spinal;
+	// by default, the cgroup of the Spinal process, only if it has no other processes
+	CgroupDir string `yaml:"cgroup_dir,omitempty" json:"cgroup_dir,omitempty"`
+
+	// Rotation and retention of the captured proc logs
+	LogRotate logs.Rotation `yaml:"log_rotate,omitempty" json:"log_rotate,omitempty"`
+
+	// Extra languages, merged over the built-in languages
+	Languages map[string]parse.CodeType `yaml:"languages,omitempty" json:"languages,omitempty"`
 }
 
 func LoadConfig(fname string) *SpinalConfig {
 	cfg := &SpinalConfig{
-		LogDir: "logs", LogExt: ".log",
+		LogDir: "logs", LogExt: ".log", DbDir: "dbs", DbType: kvstore.TypeMemory,
+		SecretsFile: "secrets.enc",
 	}
 
 	text, err := ioutil.ReadFile(fname)
@@ -32,6 +61,22 @@ func LoadConfig(fname string) *SpinalConfig {
 
 	// cleanup after config loading
 	cfg.LogDir = strings.TrimSuffix(cfg.LogDir, "/")
+	cfg.DbDir = strings.TrimSuffix(cfg.DbDir, "/")
+	// register the extra languages, before parsing any file
+	parse.LoadLanguages(cfg.Languages)
 
 	return cfg
 }
+
+// StatePath returns the path of the state file, or empty if disabled
+func (cfg *SpinalConfig) StatePath() string {
+	if cfg.StateFile == "" {
+		return ""
+	}
+	return filepath.Join(cfg.DbDir, cfg.StateFile)
+}
+
+// SecretsPath returns the path of the encrypted secrets
+func (cfg *SpinalConfig) SecretsPath() string {
+	return filepath.Join(cfg.DbDir, cfg.SecretsFile)
+}
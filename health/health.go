@@ -0,0 +1,142 @@
+// Package health runs the health checks of the recipes:
+// HTTP GET, TCP connect, shell commands and KV key freshness.
+package health
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/ShinyTrinkets/spinal/kvstore"
+	parse "github.com/ShinyTrinkets/spinal/parser"
+)
+
+// How long to wait for the output, after an exec check exits
+const waitDelay = 100 * time.Millisecond
+
+// Maximum length of the output of a failed exec check, in the reason
+const maxOutputLen = 200
+
+// Probe runs all the checks once and returns the first failure.
+// The store is the default KV store, the dir is the working dir for exec.
+func Probe(h *parse.Health, store string, dir string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.TimeLimit())
+	defer cancel()
+
+	if h.HTTP != "" {
+		if err := probeHTTP(ctx, h.HTTPAddr()); err != nil {
+			return err
+		}
+	}
+	if h.TCP != "" {
+		if err := probeTCP(ctx, h.TCPAddr()); err != nil {
+			return err
+		}
+	}
+	if h.Exec != "" {
+		if err := probeExec(ctx, h.Exec, dir); err != nil {
+			return err
+		}
+	}
+	if h.KV != nil {
+		if h.KV.Store != "" {
+			store = h.KV.Store
+		}
+		if err := probeKV(store, h.KV.Key, h.KV.Within); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func probeHTTP(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("http: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("http: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("http: %s returned %s", url, resp.Status)
+	}
+	return nil
+}
+
+func probeTCP(ctx context.Context, addr string) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("tcp: %v", err)
+	}
+	return conn.Close()
+}
+
+func probeExec(ctx context.Context, command string, dir string) error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("exec: %v", err)
+	}
+	defer r.Close()
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Dir = dir
+	// The output is a file, so Wait doesn't wait for the children that keep it open
+	cmd.Stdout = w
+	cmd.Stderr = w
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return fmt.Errorf("exec: %v", err)
+	}
+
+	var out bytes.Buffer
+	read := make(chan struct{})
+	go func() {
+		io.Copy(&out, r)
+		close(read)
+	}()
+	err = cmd.Wait()
+	select {
+	case <-read:
+	case <-time.After(waitDelay):
+		// The children still have the output open
+		r.Close()
+		<-read
+	}
+
+	if ctx.Err() != nil {
+		return errors.New("exec: timeout")
+	}
+	if err != nil {
+		msg := strings.TrimSpace(out.String())
+		if len(msg) > maxOutputLen {
+			msg = msg[:maxOutputLen] + "..."
+		}
+		if msg == "" {
+			return fmt.Errorf("exec: %v", err)
+		}
+		return fmt.Errorf("exec: %v: %s", err, msg)
+	}
+	return nil
+}
+
+func probeKV(store string, key string, within time.Duration) error {
+	updated, ok := kvstore.Store(store).Updated(key)
+	if !ok {
+		return fmt.Errorf("kv: key '%s/%s' not found", store, key)
+	}
+	if age := time.Since(updated); age > within {
+		return fmt.Errorf("kv: key '%s/%s' not updated for %v", store, key, age.Round(time.Second))
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package health
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ShinyTrinkets/spinal/kvstore"
+	parse "github.com/ShinyTrinkets/spinal/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+const timeUnit = 100 * time.Millisecond
+
+func TestProbeHTTP(t *testing.T) {
+	assert := assert.New(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	h := &parse.Health{HTTP: srv.URL + "/health"}
+	assert.Nil(Probe(h, "", ""))
+	h.HTTP = srv.URL + "/x"
+	err := Probe(h, "", "")
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "503")
+}
+
+func TestProbeTCP(t *testing.T) {
+	assert := assert.New(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err)
+	addr := ln.Addr().String()
+
+	h := &parse.Health{TCP: addr}
+	assert.Nil(Probe(h, "", ""))
+	ln.Close()
+	assert.NotNil(Probe(h, "", ""))
+}
+
+func TestProbeExec(t *testing.T) {
+	assert := assert.New(t)
+	h := &parse.Health{Exec: "test -d ."}
+	assert.Nil(Probe(h, "", "."))
+
+	h.Exec = "echo broken; exit 3"
+	err := Probe(h, "", ".")
+	assert.NotNil(err)
+	assert.True(strings.HasSuffix(err.Error(), "broken"))
+
+	// A child that keeps the output open doesn't delay the check
+	h.Exec = "sleep 2 & echo bg; exit 4"
+	start := time.Now()
+	assert.Equal("exec: exit status 4: bg", Probe(h, "", ".").Error())
+	assert.True(time.Since(start) < time.Second)
+
+	h.Exec = "sleep 1"
+	h.Timeout = timeUnit
+	assert.Equal("exec: timeout", Probe(h, "", ".").Error())
+}
+
+func TestProbeKV(t *testing.T) {
+	assert := assert.New(t)
+	h := &parse.Health{KV: &parse.KVHealth{Key: "beat", Within: timeUnit}}
+	assert.NotNil(Probe(h, "probe-kv", ""))
+
+	kvstore.Store("probe-kv").Set("beat", 1, -1)
+	assert.Nil(Probe(h, "probe-kv", ""))
+	time.Sleep(2 * timeUnit)
+	assert.NotNil(Probe(h, "probe-kv", ""))
+
+	h.KV.Store = "other-kv"
+	kvstore.Store("other-kv").Set("beat", 1, -1)
+	assert.Nil(Probe(h, "probe-kv", ""))
+}
@@ -1,14 +1,54 @@
 package http
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/ShinyTrinkets/spinal/kvstore"
 	"github.com/labstack/echo"
 )
 
+// Pagination of the keys
+const (
+	defaultKeysLimit = 100
+	maxKeysLimit     = 1000
+)
+
+// The longest long-poll on a key
+const maxWait = 5 * time.Minute
+
+// The response header with the revision of the key
+const revisionHeader = "X-KV-Revision"
+
+// The path of the counters of a store, that is also the path of the key "stats"
+const (
+	statsPath = "/kv/:id/stats"
+	statsKey  = "stats"
+)
+
+// KeysPage is one page of keys from a KV table
+type KeysPage struct {
+	Keys   []string `json:"keys"`
+	Total  int      `json:"total"`
+	Offset int      `json:"offset"`
+	Limit  int      `json:"limit"`
+}
+
+// BatchOp is one operation from a batch: set, or del
+type BatchOp struct {
+	Op    string      `json:"op"`
+	Key   string      `json:"key"`
+	Value interface{} `json:"value,omitempty"`
+	TTL   string      `json:"ttl,omitempty"`
+}
+
 // CacheEndpoint is a key-value cache store
 func CacheEndpoint(srv *echo.Echo) {
 	// List all stores
@@ -17,37 +57,348 @@ func CacheEndpoint(srv *echo.Echo) {
 		return c.JSON(http.StatusOK, kvList)
 	})
 
-	srv.GET("/kv/:id/:key", func(c echo.Context) error {
+	// List the keys of a store
+	// Query params: prefix, offset, limit
+	srv.GET("/kv/:id", func(c echo.Context) error {
 		id, err := url.PathUnescape(c.Param("id"))
 		if err != nil {
 			return c.String(http.StatusBadRequest, "Invalid ID")
 		}
-		key, err := url.PathUnescape(c.Param("key"))
+		if !kvstore.Has(id) {
+			return c.String(http.StatusNotFound, "Store not found")
+		}
+		offset, err := intParam(c, "offset", 0)
 		if err != nil {
-			return c.String(http.StatusBadRequest, "Invalid key")
+			return c.String(http.StatusBadRequest, "Invalid offset")
+		}
+		limit, err := intParam(c, "limit", defaultKeysLimit)
+		if err != nil || limit < 1 {
+			return c.String(http.StatusBadRequest, "Invalid limit")
+		}
+		if limit > maxKeysLimit {
+			limit = maxKeysLimit
+		}
+
+		keys := kvstore.Store(id).Keys(c.QueryParam("prefix"))
+		page := KeysPage{Keys: []string{}, Total: len(keys), Offset: offset, Limit: limit}
+		if offset < len(keys) {
+			end := offset + limit
+			if end > len(keys) {
+				end = len(keys)
+			}
+			page.Keys = keys[offset:end]
+		}
+		return c.JSON(http.StatusOK, page)
+	})
+
+	// Get the counters of a store: items, estimated size, hits, misses, evictions.
+	// This route takes precedence over GET /kv/:id/:key, so a key named "stats"
+	// must be read with an escaped name, eg: /kv/:id/%73tats;
+	// the other methods on this path change the key "stats"
+	srv.GET(statsPath, func(c echo.Context) error {
+		id, err := url.PathUnescape(c.Param("id"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid ID")
+		}
+		if !kvstore.Has(id) {
+			return c.String(http.StatusNotFound, "Store not found")
+		}
+		return c.JSON(http.StatusOK, kvstore.Store(id).Stats())
+	})
+
+	// Drop a store, with all the keys
+	srv.DELETE("/kv/:id", func(c echo.Context) error {
+		id, err := url.PathUnescape(c.Param("id"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid ID")
+		}
+		if !kvstore.Drop(id) {
+			return c.String(http.StatusNotFound, "Store not found")
+		}
+		return c.String(http.StatusOK, "OK")
+	})
+
+	// Get a value, with its revision in the X-KV-Revision header.
+	// Long-poll with the wait query param (eg: 30s), until the key changes
+	// after the rev query param, or after the current revision without rev;
+	// on timeout, the current value is returned, with the same revision.
+	// A missing store is not created, so there is nothing to wait for.
+	srv.GET("/kv/:id/:key", func(c echo.Context) error {
+		id, key, err := kvParams(c)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		wait, err := ttlParam(c.QueryParam("wait"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid wait")
+		}
+		kv, exists := kvstore.Lookup(id)
+		if !exists {
+			return c.String(http.StatusNotFound, "Key not found")
+		}
+
+		// The hit or the miss is counted once, after waiting
+		if wait > 0 {
+			if wait > maxWait {
+				wait = maxWait
+			}
+			rev := kv.KeyRevision(key)
+			if text := c.QueryParam("rev"); text != "" {
+				if rev, err = strconv.ParseUint(text, 10, 64); err != nil {
+					return c.String(http.StatusBadRequest, "Invalid revision")
+				}
+			}
+			ctx, cancel := context.WithTimeout(c.Request().Context(), wait)
+			kv.Wait(ctx, key, rev)
+			cancel()
+		}
+
+		data, rev, ok := kv.GetRevision(key)
+		c.Response().Header().Set(revisionHeader, strconv.FormatUint(rev, 10))
+		if !ok {
+			return c.String(http.StatusNotFound, "Key not found")
 		}
-		kv := kvstore.Store(id)
-		data, _ := kv.Get(key)
 		return c.JSON(http.StatusOK, data)
 	})
 
-	srv.POST("/kv/:id/:key", func(c echo.Context) error {
+	// Stream the changes of a store with Server-Sent Events;
+	// the prefix query param selects the keys, eg: /events/kv/jobs?prefix=job:
+	// A missing store is not created.
+	srv.GET("/events/kv/:id", func(c echo.Context) error {
 		id, err := url.PathUnescape(c.Param("id"))
 		if err != nil {
 			return c.String(http.StatusBadRequest, "Invalid ID")
 		}
-		key, err := url.PathUnescape(c.Param("key"))
+		kv, exists := kvstore.Lookup(id)
+		if !exists {
+			return c.String(http.StatusNotFound, "Store not found")
+		}
+		changes, stop := kv.Watch(c.QueryParam("prefix"))
+		defer stop()
+
+		resp := streamResponse(c)
+		resp.Flush()
+
+		ticker := time.NewTicker(keepAliveInterval)
+		defer ticker.Stop()
+		ctx := c.Request().Context()
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+				fmt.Fprint(resp, ": ping\n\n")
+				resp.Flush()
+			case ch, ok := <-changes:
+				if !ok {
+					// The store was dropped
+					return nil
+				}
+				data, err := json.Marshal(ch)
+				if err != nil {
+					continue
+				}
+				fmt.Fprintf(resp, "id: %d\nevent: %s\ndata: %s\n\n", ch.Rev, ch.Op, data)
+				resp.Flush()
+			}
+		}
+	})
+
+	// Apply a batch of set and delete operations, atomically, eg:
+	// [{"op": "set", "key": "a", "value": 1, "ttl": "10s"}, {"op": "del", "key": "b"}]
+	srv.POST("/kv/:id", func(c echo.Context) error {
+		id, err := url.PathUnescape(c.Param("id"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid ID")
+		}
+		batch := []BatchOp{}
+		if err := json.NewDecoder(c.Request().Body).Decode(&batch); err != nil {
+			return c.String(http.StatusBadRequest, "Invalid JSON batch!")
+		}
+		ops := []kvstore.Op{}
+		for _, b := range batch {
+			ttl, err := ttlParam(b.TTL)
+			if err != nil {
+				return c.String(http.StatusBadRequest, err.Error())
+			}
+			if b.Key == "" || (b.Op == kvstore.OpSet && b.Value == nil) {
+				return c.String(http.StatusBadRequest, "Invalid batch operation!")
+			}
+			ops = append(ops, kvstore.Op{Op: b.Op, Key: b.Key, Value: b.Value, TTL: ttl})
+		}
+		if err := kvstore.Store(id).Batch(ops); err == kvstore.ErrDropped {
+			return c.String(http.StatusConflict, err.Error())
+		} else if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		return c.String(http.StatusOK, "OK")
+	})
+
+	// Set a value, from the JSON body, or from the data query param.
+	// The ttl query param is a duration (eg: 10s, 5m), or a number of seconds;
+	// without ttl, the value is stored forever.
+	// With if_absent=true, the value is set only if the key doesn't exist,
+	// otherwise the current value is returned with a conflict status.
+	setValue := func(c echo.Context) error {
+		id, key, err := kvParams(c)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		value, err := readValue(c)
 		if err != nil {
-			return c.String(http.StatusBadRequest, "Invalid key")
+			return c.String(http.StatusBadRequest, err.Error())
 		}
-		data := c.QueryParam("data")
-		if data == "" {
-			return c.String(http.StatusBadRequest, "Data cannot be empty!")
+		ttl, err := ttlParam(c.QueryParam("ttl"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
 		}
-		var i interface{}
-		json.Unmarshal([]byte(data), &i)
 		kv := kvstore.Store(id)
-		kv.Set(key, i, -1)
+		if c.QueryParam("if_absent") == "true" {
+			if current, ok := kv.SetIfAbsent(key, value, ttl); !ok {
+				return c.JSON(http.StatusConflict, current)
+			}
+			return c.String(http.StatusOK, "OK")
+		}
+		if err := kv.Set(key, value, ttl); err != nil {
+			return c.String(http.StatusConflict, err.Error())
+		}
 		return c.String(http.StatusOK, "OK")
+	}
+	srv.POST("/kv/:id/:key", setValue)
+	srv.PUT("/kv/:id/:key", setValue)
+	srv.POST(statsPath, setValue)
+	srv.PUT(statsPath, setValue)
+
+	// Compare and swap, with the old and the new values in the body:
+	// {"old": 1, "new": 2}; the ttl query param applies to the new value.
+	// If the current value is different, it's returned with a conflict status.
+	srv.POST("/kv/:id/:key/cas", func(c echo.Context) error {
+		id, key, err := kvParams(c)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		swap := struct {
+			Old interface{} `json:"old"`
+			New interface{} `json:"new"`
+		}{}
+		if err := json.NewDecoder(c.Request().Body).Decode(&swap); err != nil {
+			return c.String(http.StatusBadRequest, "Invalid JSON data!")
+		}
+		ttl, err := ttlParam(c.QueryParam("ttl"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		if !kvstore.Has(id) {
+			return c.String(http.StatusNotFound, "Key not found")
+		}
+		kv := kvstore.Store(id)
+		current, ok := kv.CompareAndSwap(key, swap.Old, swap.New, ttl)
+		if !ok {
+			if !kv.Exists(key) {
+				return c.String(http.StatusNotFound, "Key not found")
+			}
+			return c.JSON(http.StatusConflict, current)
+		}
+		return c.JSON(http.StatusOK, current)
+	})
+
+	// Increment a number with the by query param (default 1), and return it.
+	// A missing key starts from 0; the ttl query param applies only to new keys.
+	srv.POST("/kv/:id/:key/incr", func(c echo.Context) error {
+		id, key, err := kvParams(c)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		by := 1.0
+		if text := c.QueryParam("by"); text != "" {
+			if by, err = strconv.ParseFloat(text, 64); err != nil {
+				return c.String(http.StatusBadRequest, "Invalid increment")
+			}
+		}
+		ttl, err := ttlParam(c.QueryParam("ttl"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		n, err := kvstore.Store(id).Increment(key, by, ttl)
+		if err != nil {
+			return c.String(http.StatusConflict, err.Error())
+		}
+		return c.JSON(http.StatusOK, n)
 	})
+
+	deleteValue := func(c echo.Context) error {
+		id, key, err := kvParams(c)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		if !kvstore.Has(id) || !kvstore.Store(id).Exists(key) {
+			return c.String(http.StatusNotFound, "Key not found")
+		}
+		if err := kvstore.Store(id).Delete(key); err != nil {
+			return c.String(http.StatusConflict, err.Error())
+		}
+		return c.String(http.StatusOK, "OK")
+	}
+	srv.DELETE("/kv/:id/:key", deleteValue)
+	srv.DELETE(statsPath, deleteValue)
+}
+
+// kvParams returns the store ID and the key from the URL
+func kvParams(c echo.Context) (string, string, error) {
+	id, err := url.PathUnescape(c.Param("id"))
+	if err != nil {
+		return "", "", errors.New("Invalid ID")
+	}
+	if c.Path() == statsPath {
+		return id, statsKey, nil
+	}
+	key, err := url.PathUnescape(c.Param("key"))
+	if err != nil {
+		return "", "", errors.New("Invalid key")
+	}
+	return id, key, nil
+}
+
+// readValue decodes the JSON value from the body, or from the data query param
+func readValue(c echo.Context) (interface{}, error) {
+	body, err := ioutil.ReadAll(c.Request().Body)
+	if err != nil {
+		return nil, errors.New("Cannot read the body!")
+	}
+	if len(body) == 0 {
+		body = []byte(c.QueryParam("data"))
+	}
+	if len(body) == 0 {
+		return nil, errors.New("Data cannot be empty!")
+	}
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return nil, errors.New("Invalid JSON data!")
+	}
+	return value, nil
+}
+
+// ttlParam converts the ttl query param into a duration;
+// without ttl, the value never expires
+func ttlParam(text string) (time.Duration, error) {
+	if text == "" {
+		return -1, nil
+	}
+	if secs, err := strconv.ParseUint(text, 10, 32); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second, nil
+	}
+	if ttl, err := time.ParseDuration(text); err == nil && ttl > 0 {
+		return ttl, nil
+	}
+	return 0, errors.New("Invalid TTL")
+}
+
+// intParam returns a positive number from the query params
+func intParam(c echo.Context, name string, def int) (int, error) {
+	text := c.QueryParam(name)
+	if text == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseUint(text, 10, 31)
+	return int(n), err
 }
@@ -0,0 +1,122 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ShinyTrinkets/spinal/secrets"
+	"github.com/ShinyTrinkets/spinal/state"
+	"github.com/labstack/echo"
+	"golang.org/x/net/websocket"
+)
+
+// EventsEndpoint streams the StateTree events, with Server-Sent Events
+// on /events, or with WebSocket on /events/ws.
+// Query params: recipe=path-or-ID and type=event-type, comma separated,
+// or repeated, eg: /events?recipe=collector&type=proc.state,health
+func EventsEndpoint(srv *echo.Echo) {
+	srv.GET("/events", func(c echo.Context) error {
+		filter := parseEventFilter(c)
+		events, unsubscribe := state.Subscribe()
+		defer unsubscribe()
+
+		resp := streamResponse(c)
+		resp.Flush()
+
+		ticker := time.NewTicker(keepAliveInterval)
+		defer ticker.Stop()
+		ctx := c.Request().Context()
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+				fmt.Fprint(resp, ": ping\n\n")
+				resp.Flush()
+			case e := <-events:
+				if !filter.Match(e) {
+					continue
+				}
+				data, err := json.Marshal(e)
+				if err != nil {
+					continue
+				}
+				fmt.Fprintf(resp, "event: %s\ndata: %s\n\n", e.Type, secrets.Redact(string(data)))
+				resp.Flush()
+			}
+		}
+	})
+
+	srv.GET("/events/ws", func(c echo.Context) error {
+		filter := parseEventFilter(c)
+		// Any origin is accepted, like the rest of the API
+		ws := websocket.Server{Handler: func(conn *websocket.Conn) {
+			defer conn.Close()
+			events, unsubscribe := state.Subscribe()
+			defer unsubscribe()
+
+			// The client messages are ignored, but reading detects the disconnect
+			closed := make(chan struct{})
+			go func() {
+				defer close(closed)
+				var msg string
+				for websocket.Message.Receive(conn, &msg) == nil {
+				}
+			}()
+
+			for {
+				select {
+				case <-closed:
+					return
+				case e := <-events:
+					if !filter.Match(e) {
+						continue
+					}
+					data, err := json.Marshal(e)
+					if err != nil {
+						continue
+					}
+					if websocket.Message.Send(conn, secrets.Redact(string(data))) != nil {
+						return
+					}
+				}
+			}
+		}}
+		ws.ServeHTTP(c.Response(), c.Request())
+		return nil
+	})
+}
+
+// streamResponse starts a Server-Sent Events response
+func streamResponse(c echo.Context) *echo.Response {
+	resp := c.Response()
+	resp.Header().Set(echo.HeaderContentType, "text/event-stream")
+	resp.Header().Set("Cache-Control", "no-cache")
+	resp.Header().Set("Connection", "keep-alive")
+	resp.WriteHeader(http.StatusOK)
+	return resp
+}
+
+// parseEventFilter reads the event filter from the query params
+func parseEventFilter(c echo.Context) state.EventFilter {
+	return state.EventFilter{
+		Recipes: splitParams(c.QueryParams()["recipe"]),
+		Types:   splitParams(c.QueryParams()["type"]),
+	}
+}
+
+// splitParams splits the comma separated values of a query param
+func splitParams(values []string) []string {
+	list := []string{}
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
@@ -0,0 +1,119 @@
+package http
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ShinyTrinkets/spinal/kvstore"
+	"github.com/labstack/echo"
+)
+
+// The default TTL of the leases
+const defaultLeaseTTL = 30 * time.Second
+
+// LocksEndpoint enables the locks, with leases that expire
+func LocksEndpoint(srv *echo.Echo) {
+	// List all the current leases
+	srv.GET("/lock", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, kvstore.Leases())
+	})
+
+	// Get the current lease of a lock
+	srv.GET("/lock/:name", func(c echo.Context) error {
+		name, err := url.PathUnescape(c.Param("name"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid name")
+		}
+		lease, ok := kvstore.GetLease(name)
+		if !ok {
+			return c.String(http.StatusNotFound, "Lock not held")
+		}
+		return c.JSON(http.StatusOK, lease)
+	})
+
+	// Acquire a lock, for the owner query param (eg: $SPIN_ID).
+	// Query params: ttl (default 30s), wait for the lock to be free (eg: 10s).
+	// The lease has the token used to renew and release the lock.
+	// If the lock is held, the current lease is returned with a conflict status.
+	srv.POST("/lock/:name", func(c echo.Context) error {
+		name, err := url.PathUnescape(c.Param("name"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid name")
+		}
+		owner := c.QueryParam("owner")
+		if owner == "" {
+			return c.String(http.StatusBadRequest, "The owner is required")
+		}
+		ttl, err := leaseTTL(c)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		wait, err := ttlParam(c.QueryParam("wait"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid wait")
+		}
+		if wait < 0 {
+			wait = 0
+		} else if wait > maxWait {
+			wait = maxWait
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request().Context(), wait)
+		defer cancel()
+		lease, err := kvstore.AcquireWait(ctx, name, owner, ttl)
+		return leaseResponse(c, lease, err)
+	})
+
+	// Renew a lease with the token query param; the ttl query param starts from now
+	srv.POST("/lock/:name/renew", func(c echo.Context) error {
+		name, err := url.PathUnescape(c.Param("name"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid name")
+		}
+		ttl, err := leaseTTL(c)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		lease, err := kvstore.Renew(name, c.QueryParam("token"), ttl)
+		return leaseResponse(c, lease, err)
+	})
+
+	// Release a lock with the token query param
+	srv.DELETE("/lock/:name", func(c echo.Context) error {
+		name, err := url.PathUnescape(c.Param("name"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid name")
+		}
+		err = kvstore.Release(name, c.QueryParam("token"))
+		if err == kvstore.ErrNoLease {
+			return c.String(http.StatusNotFound, "Lock not held")
+		} else if err != nil {
+			return c.String(http.StatusConflict, err.Error())
+		}
+		return c.String(http.StatusOK, "OK")
+	})
+}
+
+// leaseTTL returns the ttl query param, or the default TTL
+func leaseTTL(c echo.Context) (time.Duration, error) {
+	ttl, err := ttlParam(c.QueryParam("ttl"))
+	if ttl < 0 {
+		ttl = defaultLeaseTTL
+	}
+	return ttl, err
+}
+
+// leaseResponse returns the lease, or the current lease on conflict
+func leaseResponse(c echo.Context, lease kvstore.Lease, err error) error {
+	switch err {
+	case nil:
+		return c.JSON(http.StatusOK, lease)
+	case kvstore.ErrLocked:
+		return c.JSON(http.StatusConflict, lease)
+	case kvstore.ErrNoLease:
+		return c.String(http.StatusNotFound, "Lock not held")
+	}
+	return c.String(http.StatusInternalServerError, err.Error())
+}
@@ -6,26 +6,72 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
-	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	config "github.com/ShinyTrinkets/spinal/config"
+	"github.com/ShinyTrinkets/spinal/logs"
 	util "github.com/ShinyTrinkets/spinal/util"
 	"github.com/labstack/echo"
 )
 
-type LogEntry struct {
-	Level uint   `json:"level"`
-	Time  uint   `json:"time"`
-	Msg   string `json:"msg"`
-	Pid   uint   `json:"pid,omitempty"`
+// LogEntry is one line from a log file;
+// the output of the procs is captured in the same format
+type LogEntry = logs.Entry
+
+// LogAppender writes one entry into a log, by ID,
+// with the writer that captures the output of the procs
+type LogAppender func(id string, e LogEntry) error
+
+// How often to check a log file for new lines, when streaming
+const followInterval = 250 * time.Millisecond
+
+// How often to send a comment, to keep the stream alive
+const keepAliveInterval = 15 * time.Second
+
+// The lines sent from a log file, when the stream starts
+const defaultBacklog = 10
+
+// parseLogQuery returns the filter and the number of lines
+// to backfill, from the query params of a log stream
+func parseLogQuery(c echo.Context) (logs.Filter, int, error) {
+	filter := logs.Filter{}
+	lines := defaultBacklog
+	if lvl := c.QueryParam("level"); lvl != "" {
+		level, err := logs.ParseLevel(lvl)
+		if err != nil {
+			return filter, 0, err
+		}
+		filter.Level = level
+	}
+	if since := c.QueryParam("since"); since != "" {
+		ms, err := logs.ParseSince(since, time.Now())
+		if err != nil {
+			return filter, 0, err
+		}
+		filter.Since = ms
+		// All the lines after the time, unless limited
+		lines = 0
+	}
+	if n := c.QueryParam("lines"); n != "" {
+		num, err := strconv.ParseUint(n, 10, 32)
+		if err != nil {
+			return filter, 0, fmt.Errorf("invalid lines: %s", n)
+		}
+		lines = int(num)
+		if lines == 0 && filter.Since == 0 {
+			// No backfill
+			lines = -1
+		}
+	}
+	return filter, lines, nil
 }
 
 // LogsEndpoint enables log read/write endpoints
-func LogsEndpoint(srv *echo.Echo, cfg *config.SpinalConfig) {
+func LogsEndpoint(srv *echo.Echo, cfg *config.SpinalConfig, appendLog LogAppender) {
 	// List all logs
 	srv.GET("/logs", func(c echo.Context) error {
 		files, err := ioutil.ReadDir(cfg.LogDir)
@@ -52,7 +98,74 @@ func LogsEndpoint(srv *echo.Echo, cfg *config.SpinalConfig) {
 		if err != nil {
 			return c.String(http.StatusBadRequest, "Cannot read log file!")
 		}
-		return c.String(http.StatusBadRequest, string(text))
+		return c.String(http.StatusOK, string(text))
+	})
+
+	// Stream a log with Server-Sent Events; file ext is added automatically.
+	// Query params: lines=N to backfill the last N lines (default 10),
+	// since=T to backfill the lines after a time, level=L for a minimum level,
+	// follow=false to stop after the backfill.
+	srv.GET("/log/:id/stream", func(c echo.Context) error {
+		id, err := url.PathUnescape(c.Param("id"))
+		if err != nil || strings.Contains(id, "/") {
+			return c.String(http.StatusBadRequest, "Invalid ID")
+		}
+		filter, lines, err := parseLogQuery(c)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		logFile := cfg.LogDir + "/" + id + cfg.LogExt
+		backlog, offset, err := logs.ReadLast(logFile, lines, filter)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Cannot read log file!")
+		}
+
+		resp := streamResponse(c)
+
+		var lock sync.Mutex
+		send := func(line []byte) {
+			if _, ok := logs.ParseLine(line); !ok {
+				// All the events are JSON log entries
+				line, _ = json.Marshal(LogEntry{Msg: string(line)})
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			fmt.Fprintf(resp, "data: %s\n\n", line)
+			resp.Flush()
+		}
+		if lines < 0 {
+			backlog = nil
+		}
+		for _, line := range backlog {
+			send(line)
+		}
+		if c.QueryParam("follow") == "false" {
+			return nil
+		}
+
+		ctx := c.Request().Context()
+		// Keep the connection alive, when there are no new lines
+		go func() {
+			ticker := time.NewTicker(keepAliveInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					lock.Lock()
+					fmt.Fprint(resp, ": ping\n\n")
+					resp.Flush()
+					lock.Unlock()
+				}
+			}
+		}()
+		logs.Follow(ctx, logFile, offset, followInterval, func(line []byte) {
+			if filter.Match(line) {
+				send(line)
+			}
+		})
+		return nil
 	})
 
 	// Append to a log; file ext is added automatically
@@ -60,7 +173,7 @@ func LogsEndpoint(srv *echo.Echo, cfg *config.SpinalConfig) {
 		// Using the pino & pino-pretty log format
 		// https://github.com/pinojs/pino-pretty
 		id, err := url.PathUnescape(c.Param("id"))
-		if err != nil {
+		if err != nil || strings.Contains(id, "/") {
 			return c.String(http.StatusBadRequest, "Invalid ID")
 		}
 		msg := strings.Trim(c.QueryParam("msg"), " ")
@@ -77,30 +190,15 @@ func LogsEndpoint(srv *echo.Echo, cfg *config.SpinalConfig) {
 			fmt.Printf("Invalid PID value! Error: %v\n", err)
 		}
 
-		logFile := cfg.LogDir + "/" + id + cfg.LogExt
-		// create if it doesn't exist
-		if !util.IsFile(logFile) {
-			err := ioutil.WriteFile(logFile, []byte(""), 0644)
-			if err != nil {
-				return c.String(http.StatusBadRequest, "Cannot create log file!")
-			}
-		}
-		// start appending to the log
-		file, err := os.OpenFile(logFile, os.O_APPEND|os.O_WRONLY, 0644)
-		if err != nil {
-			return c.String(http.StatusBadRequest, "Cannot open log file for append!")
-		}
-		defer file.Close()
-
 		ts := int64(time.Nanosecond) * time.Now().UnixNano() / int64(time.Millisecond)
 		le := LogEntry{Level: uint(lvl), Time: uint(ts), Msg: msg}
 		if pid != 0 {
 			le.Pid = uint(pid)
 		}
-		line, _ := json.Marshal(le)
-		if _, err := file.WriteString(string(line) + "\n"); err != nil {
+		// The log file is shared with the procs output, and rotated with it
+		if err := appendLog(id, le); err != nil {
 			return c.String(http.StatusBadRequest, "Cannot append into log file!")
 		}
-		return c.String(http.StatusBadRequest, "OK")
+		return c.String(http.StatusOK, "OK")
 	})
 }
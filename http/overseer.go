@@ -8,15 +8,32 @@ import (
 	"time"
 
 	"github.com/ShinyTrinkets/overseer"
+	"github.com/ShinyTrinkets/spinal/state"
 	quote "github.com/kballard/go-shellquote"
 	"github.com/labstack/echo"
 )
 
-// OverseerEndpoint enables Overseer endpoints
-func OverseerEndpoint(srv *echo.Echo, ovr *overseer.Overseer) {
+// OverseerEndpoint enables Overseer endpoints.
+// The hidden procs are internal: they cannot be listed, stopped, or replaced.
+func OverseerEndpoint(srv *echo.Echo, ovr *overseer.Overseer, hidden ...string) {
+	isHidden := func(id string) bool {
+		for _, h := range hidden {
+			if h == id {
+				return true
+			}
+		}
+		return false
+	}
+
 	// List all procs
 	srv.GET("/procs", func(c echo.Context) error {
-		return c.JSON(http.StatusOK, ovr.ListAll())
+		procs := []string{}
+		for _, id := range ovr.ListAll() {
+			if !isHidden(id) {
+				procs = append(procs, id)
+			}
+		}
+		return redactedJSON(c, http.StatusOK, procs)
 	})
 
 	// Get proc by ID
@@ -26,10 +43,17 @@ func OverseerEndpoint(srv *echo.Echo, ovr *overseer.Overseer) {
 		if err != nil {
 			return c.String(http.StatusBadRequest, "Invalid ID format")
 		}
-		if ovr.HasProc(id) {
-			return c.JSON(http.StatusOK, ovr.Status(id))
+		if !ovr.HasProc(id) || isHidden(id) {
+			return c.String(http.StatusBadRequest, "Invalid proc ID")
+		}
+		// Add the Spinal properties, eg: restart policy, restart count
+		status := ovr.Status(id)
+		if state.HasLevel2(status.Group, id) {
+			h := state.GetLevel2(status.Group, id)
+			h.ProcessJSON = *status
+			return redactedJSON(c, http.StatusOK, h)
 		}
-		return c.String(http.StatusBadRequest, "Invalid proc ID")
+		return redactedJSON(c, http.StatusOK, status)
 	})
 
 	// Add, Supervise and Remove a process when complete
@@ -39,6 +63,9 @@ func OverseerEndpoint(srv *echo.Echo, ovr *overseer.Overseer) {
 			return c.String(http.StatusBadRequest,
 				fmt.Sprintf("No ID! Error: %v\n", err))
 		}
+		if isHidden(id) {
+			return c.String(http.StatusBadRequest, "Invalid proc ID")
+		}
 
 		ovr.Stop(id)
 		time.Sleep(250 * time.Millisecond)
@@ -55,6 +82,10 @@ func OverseerEndpoint(srv *echo.Echo, ovr *overseer.Overseer) {
 				fmt.Sprintf("No ID! Error: %v\n", err))
 		}
 
+		if isHidden(id) {
+			return c.String(http.StatusBadRequest, "Invalid proc ID")
+		}
+
 		exec := c.QueryParam("exec")
 		if exec == "" {
 			return c.String(http.StatusBadRequest, "Exec command cannot be empty!")
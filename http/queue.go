@@ -0,0 +1,184 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ShinyTrinkets/spinal/kvstore"
+	"github.com/labstack/echo"
+)
+
+// QueueEndpoint enables the work queues on /queue,
+// and the pub/sub topics on /topic
+func QueueEndpoint(srv *echo.Echo) {
+	// List all queues
+	srv.GET("/queue", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, kvstore.ListQueues())
+	})
+
+	// Get the counters of a queue
+	srv.GET("/queue/:name", func(c echo.Context) error {
+		name, err := url.PathUnescape(c.Param("name"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid name")
+		}
+		if !kvstore.HasQueue(name) {
+			return c.String(http.StatusNotFound, "Queue not found")
+		}
+		return c.JSON(http.StatusOK, kvstore.GetQueue(name).Stats())
+	})
+
+	// Push a message, from the JSON body, or from the data query param
+	srv.POST("/queue/:name", func(c echo.Context) error {
+		name, err := url.PathUnescape(c.Param("name"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid name")
+		}
+		body, err := readValue(c)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		return c.JSON(http.StatusOK, kvstore.GetQueue(name).Push(body))
+	})
+
+	// Pop the first message, waiting for one with the wait query param (eg: 30s).
+	// The message must be acked before the visibility query param (default 30s),
+	// otherwise it's delivered again. Without messages, the status is 204;
+	// when the queue is dropped, the status is 410.
+	srv.POST("/queue/:name/pop", func(c echo.Context) error {
+		name, err := url.PathUnescape(c.Param("name"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid name")
+		}
+		wait, err := ttlParam(c.QueryParam("wait"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid wait")
+		}
+		visibility, err := ttlParam(c.QueryParam("visibility"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid visibility")
+		}
+		if wait < 0 {
+			wait = 0
+		} else if wait > maxWait {
+			wait = maxWait
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request().Context(), wait)
+		defer cancel()
+		m, err := kvstore.GetQueue(name).Pop(ctx, visibility)
+		if err == kvstore.ErrQueueDropped {
+			return c.String(http.StatusGone, err.Error())
+		} else if err != nil {
+			return c.NoContent(http.StatusNoContent)
+		}
+		return c.JSON(http.StatusOK, m)
+	})
+
+	// Acknowledge a popped message, by receipt
+	srv.POST("/queue/:name/ack/:receipt", func(c echo.Context) error {
+		return receiptAction(c, (*kvstore.Queue).Ack)
+	})
+
+	// Make a popped message visible again, by receipt
+	srv.POST("/queue/:name/requeue/:receipt", func(c echo.Context) error {
+		return receiptAction(c, (*kvstore.Queue).Requeue)
+	})
+
+	// Drop a queue, with all the messages
+	srv.DELETE("/queue/:name", func(c echo.Context) error {
+		name, err := url.PathUnescape(c.Param("name"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid name")
+		}
+		if !kvstore.DropQueue(name) {
+			return c.String(http.StatusNotFound, "Queue not found")
+		}
+		return c.String(http.StatusOK, "OK")
+	})
+
+	// List all topics
+	srv.GET("/topic", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, kvstore.ListTopics())
+	})
+
+	// Publish a message to all the subscribers,
+	// from the JSON body, or from the data query param
+	srv.POST("/topic/:name", func(c echo.Context) error {
+		name, err := url.PathUnescape(c.Param("name"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid name")
+		}
+		body, err := readValue(c)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		m, sent := kvstore.GetTopic(name).Publish(body)
+		return c.JSON(http.StatusOK, map[string]interface{}{"id": m.ID, "subscribers": sent})
+	})
+
+	// Subscribe to a topic, with Server-Sent Events
+	srv.GET("/topic/:name", func(c echo.Context) error {
+		name, err := url.PathUnescape(c.Param("name"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid name")
+		}
+		messages, unsubscribe := kvstore.GetTopic(name).Subscribe()
+		defer unsubscribe()
+
+		resp := streamResponse(c)
+		resp.Flush()
+
+		ticker := time.NewTicker(keepAliveInterval)
+		defer ticker.Stop()
+		ctx := c.Request().Context()
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+				fmt.Fprint(resp, ": ping\n\n")
+				resp.Flush()
+			case m, ok := <-messages:
+				if !ok {
+					// The topic was dropped
+					return nil
+				}
+				data, err := json.Marshal(m)
+				if err != nil {
+					continue
+				}
+				fmt.Fprintf(resp, "id: %s\ndata: %s\n\n", m.ID, data)
+				resp.Flush()
+			}
+		}
+	})
+
+	// Drop a topic; the subscribers are disconnected
+	srv.DELETE("/topic/:name", func(c echo.Context) error {
+		name, err := url.PathUnescape(c.Param("name"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid name")
+		}
+		if !kvstore.DropTopic(name) {
+			return c.String(http.StatusNotFound, "Topic not found")
+		}
+		return c.String(http.StatusOK, "OK")
+	})
+}
+
+// receiptAction acks, or requeues a popped message, by receipt
+func receiptAction(c echo.Context, action func(*kvstore.Queue, string) bool) error {
+	name, err := url.PathUnescape(c.Param("name"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid name")
+	}
+	if !kvstore.HasQueue(name) || !action(kvstore.GetQueue(name), c.Param("receipt")) {
+		return c.String(http.StatusNotFound, "Message not found")
+	}
+	return c.String(http.StatusOK, "OK")
+}
@@ -1,10 +1,13 @@
 package http
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/url"
 
 	logr "github.com/ShinyTrinkets/meta-logger"
+	"github.com/ShinyTrinkets/spinal/kvstore"
+	"github.com/ShinyTrinkets/spinal/secrets"
 	"github.com/ShinyTrinkets/spinal/state"
 	"github.com/facebookgo/grace/gracehttp"
 	"github.com/labstack/echo"
@@ -21,6 +24,18 @@ type (
 // Global log instance
 var log Logger
 
+// StateTree is the whole app state, with the current leases
+type StateTree struct {
+	state.Tree
+	Locks []kvstore.Lease `json:"locks"`
+}
+
+// RecipeState is the state of one recipe, with the leases held by the recipe
+type RecipeState struct {
+	state.Recipe
+	Locks []kvstore.Lease `json:"locks"`
+}
+
 // NewServer sets up a new HTTP server
 func NewServer(port string) *echo.Echo {
 	if logr.NewLogger == nil {
@@ -42,28 +57,47 @@ func NewServer(port string) *echo.Echo {
 		return c.String(http.StatusOK, "The Spinal server is running")
 	})
 
-	// Get state lvl1 by ID
+	// Get state lvl1 by ID, with all the lvl2 children, and the leases
 	// URL encoded characters in the ID are supported ("/" = "%2F")
 	srv.GET("/state/:id", func(c echo.Context) error {
 		id, err := url.PathUnescape(c.Param("id"))
 		if err != nil {
 			return c.String(http.StatusBadRequest, "Invalid ID format")
 		}
-		if state.HasLevel1(id) {
-			return c.JSON(http.StatusOK, state.GetLevel1(id))
+		if r, exists := state.GetRecipe(id); exists {
+			return redactedJSON(c, http.StatusOK, RecipeState{Recipe: r, Locks: heldBy(r.ID)})
 		}
 		return c.String(http.StatusBadRequest, "Invalid state ID")
 	})
 
-	// Get app state
-	// This looks BROKEN?
-	// srv.GET("/state", func(c echo.Context) error {
-	// 	return c.JSON(http.StatusOK, state.GetState())
-	// })
+	// Get the whole app state: the recipes, with their procs, and the leases
+	srv.GET("/state", func(c echo.Context) error {
+		return redactedJSON(c, http.StatusOK, StateTree{Tree: state.Snapshot(), Locks: kvstore.Leases()})
+	})
 
 	return srv
 }
 
+// heldBy returns the leases held by the owner
+func heldBy(owner string) []kvstore.Lease {
+	list := []kvstore.Lease{}
+	for _, lease := range kvstore.Leases() {
+		if lease.Owner == owner {
+			list = append(list, lease)
+		}
+	}
+	return list
+}
+
+// redactedJSON sends the JSON response, without the values of the secrets
+func redactedJSON(c echo.Context, code int, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.JSONBlob(code, []byte(secrets.Redact(string(data))))
+}
+
 // Serve listens and serves
 func Serve(srv *echo.Echo) {
 	log.Info("HTTP server start on '%s'", srv.Server.Addr)
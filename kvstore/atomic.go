@@ -0,0 +1,126 @@
+package kvstore
+
+import (
+	"errors"
+	"reflect"
+	"time"
+)
+
+// ErrNotNumber is returned when incrementing a value that is not a number
+var ErrNotNumber = errors.New("the value is not a number")
+
+// ErrDropped is returned when writing into a table after it was dropped
+var ErrDropped = errors.New("the table was dropped")
+
+// Batch operations
+const (
+	OpSet    = "set"
+	OpDelete = "del"
+)
+
+// Op is one operation from a batch
+type Op struct {
+	Op    string
+	Key   string
+	Value interface{}
+	TTL   time.Duration
+}
+
+// internal get, without deleting the expired items; the table must be locked
+func (c *CacheTable) lookup(key string) (item, bool) {
+	cacheItem, ok := c.items[key]
+	if !ok || (cacheItem.expire > 0 && cacheItem.expire < time.Now().UnixMicro()) {
+		return item{}, false
+	}
+	return cacheItem, true
+}
+
+// CompareAndSwap replaces the value of the key with the new value,
+// only if the key exists and the current value is equal to the old value.
+// Returns the current value, and true if the value was replaced.
+func (c *CacheTable) CompareAndSwap(key string, old, new interface{}, ttl time.Duration) (interface{}, bool) {
+	c.Lock()
+	defer c.Unlock()
+	current, ok := c.lookup(key)
+	if c.dropped {
+		return current.value, false
+	}
+	if !ok || !reflect.DeepEqual(current.value, old) {
+		return current.value, false
+	}
+	c.set(key, new, ttl)
+	return new, true
+}
+
+// SetIfAbsent adds the record only if the key doesn't exist.
+// Returns the current value, and true if the record was added.
+func (c *CacheTable) SetIfAbsent(key string, value interface{}, ttl time.Duration) (interface{}, bool) {
+	c.Lock()
+	defer c.Unlock()
+	if current, ok := c.lookup(key); ok || c.dropped {
+		return current.value, false
+	}
+	c.set(key, value, ttl)
+	return value, true
+}
+
+// Increment adds delta to the numeric value of the key, and returns the result.
+// A missing key starts from 0, with the given ttl;
+// an existing key keeps its expiry time.
+func (c *CacheTable) Increment(key string, delta float64, ttl time.Duration) (float64, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.dropped {
+		return 0, ErrDropped
+	}
+	current, ok := c.lookup(key)
+	if !ok {
+		c.set(key, delta, ttl)
+		return delta, nil
+	}
+
+	var n float64
+	switch v := current.value.(type) {
+	case float64:
+		n = v
+	case float32:
+		n = float64(v)
+	case int:
+		n = float64(v)
+	case int64:
+		n = float64(v)
+	case uint:
+		n = float64(v)
+	case uint64:
+		n = float64(v)
+	default:
+		return 0, ErrNotNumber
+	}
+	n += delta
+	current.value = n
+	c.put(key, current)
+	return n, nil
+}
+
+// Batch applies all the operations under one lock,
+// so the other clients see all the changes, or none.
+func (c *CacheTable) Batch(ops []Op) error {
+	for _, op := range ops {
+		if op.Op != OpSet && op.Op != OpDelete {
+			return errors.New("invalid batch operation: " + op.Op)
+		}
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.dropped {
+		return ErrDropped
+	}
+	for _, op := range ops {
+		if op.Op == OpSet {
+			c.set(op.Key, op.Value, op.TTL)
+		} else {
+			c.delete(op.Key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,275 @@
+package kvstore
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Storage types
+const (
+	TypeMemory = "memory" // the tables are lost on restart
+	TypeFile   = "file"   // the tables are saved in files
+)
+
+// File extensions of the tables
+const (
+	logExt  = ".log"
+	snapExt = ".snap"
+)
+
+// How many changes are written in the log, before compacting the table
+var compactEvery = 1000
+
+// The folder of the tables, empty in memory mode
+var dbDir string
+
+// record is one change from the append-only log, or one item from a snapshot
+type record struct {
+	Op      string      `json:"op,omitempty"` // set, or del
+	Key     string      `json:"key,omitempty"`
+	Value   interface{} `json:"value,omitempty"`
+	Expire  int64       `json:"expire,omitempty"`
+	Updated int64       `json:"updated,omitempty"`
+}
+
+// journal is the append-only log of one table
+type journal struct {
+	path  string // without extension
+	file  *os.File
+	count int // changes since the last compaction
+}
+
+// Open enables the file mode: each table is saved as a snapshot
+// and an append-only log with the changes after the snapshot.
+// All the tables from the folder are loaded.
+func Open(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	dbDir = dir
+	for _, f := range files {
+		ext := filepath.Ext(f.Name())
+		if ext != logExt && ext != snapExt {
+			continue
+		}
+		name, err := url.PathUnescape(strings.TrimSuffix(f.Name(), ext))
+		if err != nil {
+			continue
+		}
+		if _, exists := cache[name]; exists {
+			continue
+		}
+		t, err := loadTable(name)
+		if err != nil {
+			return err
+		}
+		t.SetLimits(limitsFor(name))
+		cache[name] = t
+	}
+	return nil
+}
+
+// Close compacts and closes all the tables; the memory mode is restored
+func Close() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	var errs []string
+	for _, t := range cache {
+		t.Lock()
+		if t.journal != nil {
+			if err := t.compact(); err != nil {
+				errs = append(errs, err.Error())
+			}
+			t.journal.file.Close()
+			t.journal = nil
+		}
+		t.Unlock()
+	}
+	dbDir = ""
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Compact writes the snapshots of the tables that changed,
+// and truncates their logs
+func Compact() error {
+	mutex.RLock()
+	tables := []*CacheTable{}
+	for _, t := range cache {
+		tables = append(tables, t)
+	}
+	mutex.RUnlock()
+
+	for _, t := range tables {
+		t.Lock()
+		var err error
+		if t.journal != nil && t.journal.count > 0 {
+			err = t.compact()
+		}
+		t.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StartCompactor compacts the tables at every interval, until Close
+func StartCompactor(interval time.Duration, onError func(error)) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			mutex.RLock()
+			stopped := dbDir == ""
+			mutex.RUnlock()
+			if stopped {
+				return
+			}
+			if err := Compact(); err != nil {
+				onError(err)
+			}
+		}
+	}()
+}
+
+// loadTable reads the snapshot of a table, replays the log,
+// and opens the log for appending
+func loadTable(name string) (*CacheTable, error) {
+	t := NewCache()
+	path := filepath.Join(dbDir, url.PathEscape(name))
+	now := time.Now().UnixMicro()
+
+	if data, err := os.ReadFile(path + snapExt); err == nil {
+		items := map[string]record{}
+		if err := json.Unmarshal(data, &items); err != nil {
+			return nil, fmt.Errorf("invalid snapshot '%s': %v", path+snapExt, err)
+		}
+		for key, r := range items {
+			t.apply(key, r, now)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	count := 0
+	if f, err := os.Open(path + logExt); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 16*1024*1024)
+		for scanner.Scan() {
+			r := record{}
+			if json.Unmarshal(scanner.Bytes(), &r) != nil {
+				// The last line might be incomplete, after a crash
+				continue
+			}
+			t.apply(r.Key, r, now)
+			count++
+		}
+		f.Close()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path+logExt, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	t.journal = &journal{path: path, file: f, count: count}
+	return t, nil
+}
+
+// apply changes an item from a snapshot or a log;
+// the expired items are dropped
+func (c *CacheTable) apply(key string, r record, now int64) {
+	if uint64(r.Updated) > c.rev {
+		c.rev = uint64(r.Updated)
+	}
+	if r.Op == "del" || (r.Expire > 0 && r.Expire < now) {
+		c.drop(key)
+		return
+	}
+	c.store(key, item{expire: r.Expire, updated: r.Updated, value: r.Value})
+}
+
+// write appends one change to the log of the table;
+// the table must be locked
+func (c *CacheTable) write(r record) {
+	if c.journal == nil {
+		return
+	}
+	line, err := json.Marshal(r)
+	if err == nil {
+		_, err = c.journal.file.Write(append(line, '\n'))
+	}
+	if err != nil {
+		fmt.Printf("Cannot write KV log '%s'! Error: %v\n", c.journal.path+logExt, err)
+		return
+	}
+	c.journal.count++
+	if c.journal.count >= compactEvery {
+		if err := c.compact(); err != nil {
+			fmt.Printf("Cannot compact KV table '%s'! Error: %v\n", c.journal.path, err)
+		}
+	}
+}
+
+// compact writes the snapshot of the table atomically, then truncates the log;
+// the table must be locked
+func (c *CacheTable) compact() error {
+	now := time.Now().UnixMicro()
+	items := map[string]record{}
+	for key, it := range c.items {
+		if it.expire > 0 && it.expire < now {
+			continue
+		}
+		items[key] = record{Value: it.value, Expire: it.expire, Updated: it.updated}
+	}
+	data, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+
+	path := c.journal.path
+	if err := os.WriteFile(path+snapExt+".tmp", data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(path+snapExt+".tmp", path+snapExt); err != nil {
+		return err
+	}
+	// The changes from the log are in the snapshot now
+	if err := c.journal.file.Truncate(0); err != nil {
+		return err
+	}
+	c.journal.count = 0
+	return nil
+}
+
+// The mutex of the store must be locked
+func newTable(name string) *CacheTable {
+	t := NewCache()
+	if dbDir != "" {
+		var err error
+		if t, err = loadTable(name); err != nil {
+			fmt.Printf("Cannot load KV table '%s', using memory! Error: %v\n", name, err)
+			t = NewCache()
+		}
+	}
+	t.SetLimits(limitsFor(name))
+	return t
+}
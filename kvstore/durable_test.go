@@ -0,0 +1,98 @@
+package kvstore
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// forget simulates a restart, dropping the tables from memory
+func forget(names ...string) {
+	mutex.Lock()
+	for _, name := range names {
+		delete(cache, name)
+	}
+	mutex.Unlock()
+}
+
+func TestDurableTables(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	assert.Nil(Open(dir))
+	table := Store("dur/1")
+	table.Set("a", "A", -1)
+	table.Set("b", 2.0, timeUnit)
+	table.Set("c", true, 0)
+	table.Delete("c")
+	assert.Nil(Close())
+	assert.FileExists(filepath.Join(dir, "dur%2F1.snap"))
+	forget("dur/1")
+
+	time.Sleep(2 * timeUnit)
+	assert.Nil(Open(dir))
+	assert.Contains(List(), "dur/1")
+	table = Store("dur/1")
+	v, ok := table.Get("a")
+	assert.True(ok)
+	assert.Equal("A", v)
+	// The TTL is preserved
+	assert.False(table.Exists("b"))
+	assert.False(table.Exists("c"))
+
+	// Replay the log, without a compaction
+	table.Set("d", 4.0, time.Hour)
+	forget("dur/1")
+	assert.Nil(Open(dir))
+	table = Store("dur/1")
+	v, _ = table.Get("d")
+	assert.Equal(4.0, v)
+	assert.True(table.Exists("a"))
+	assert.Nil(Close())
+	forget("dur/1")
+}
+
+func TestCompactEvery(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	compactEvery = 3
+	defer func() { compactEvery = 1000 }()
+
+	assert.Nil(Open(dir))
+	table := Store("dur2")
+	for _, key := range []string{"a", "b", "c", "d"} {
+		table.Set(key, key, -1)
+	}
+	log, err := os.ReadFile(filepath.Join(dir, "dur2.log"))
+	assert.Nil(err)
+	assert.Equal(1, strings.Count(string(log), "\n"))
+	assert.FileExists(filepath.Join(dir, "dur2.snap"))
+
+	assert.Nil(Compact())
+	log, _ = os.ReadFile(filepath.Join(dir, "dur2.log"))
+	assert.Equal(0, len(log))
+
+	// Deleting a missing key doesn't write in the log
+	table.Delete("x")
+	log, _ = os.ReadFile(filepath.Join(dir, "dur2.log"))
+	assert.Equal(0, len(log))
+	assert.Nil(Close())
+	forget("dur2")
+}
+
+func TestDropDurable(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	assert.Nil(Open(dir))
+	Store("dur3").Set("x", 1, -1)
+	assert.Nil(Compact())
+	assert.True(Drop("dur3"))
+	assert.NoFileExists(filepath.Join(dir, "dur3.log"))
+	assert.NoFileExists(filepath.Join(dir, "dur3.snap"))
+	assert.Nil(Close())
+}
@@ -0,0 +1,188 @@
+package kvstore
+
+import (
+	"container/list"
+	"encoding/json"
+	"sync/atomic"
+)
+
+// Eviction policies, used when a table is over its limits
+const (
+	EvictLRU    = "lru"    // the least recently used keys first
+	EvictExpiry = "expiry" // the keys that expire first, then the least recently used
+)
+
+// The estimated memory used by one item, without the key and the value
+const itemOverhead = 64
+
+// Limits bound the size of a table; zero means no limit.
+// The size of a value is estimated from its JSON encoding.
+type Limits struct {
+	MaxItems int    `yaml:"max_items,omitempty" json:"max_items,omitempty"`
+	MaxBytes int64  `yaml:"max_bytes,omitempty" json:"max_bytes,omitempty"`
+	Evict    string `yaml:"evict,omitempty" json:"evict,omitempty"` // lru (default), or expiry
+}
+
+// Stats are the counters of a table
+type Stats struct {
+	Items     int    `json:"items"`
+	Bytes     int64  `json:"bytes"` // estimated
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Revision  uint64 `json:"revision"`
+	Limits    Limits `json:"limits"`
+}
+
+// The limits of the new tables: the defaults, and the limits by table name
+var (
+	defaultLimits Limits
+	tableLimits   = map[string]Limits{}
+)
+
+func (l Limits) bounded() bool {
+	return l.MaxItems > 0 || l.MaxBytes > 0
+}
+
+// SetDefaultLimits sets the limits of all the tables,
+// and the limits of specific tables, by name.
+// The existing tables are bounded immediately.
+func SetDefaultLimits(def Limits, tables map[string]Limits) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	defaultLimits = def
+	tableLimits = map[string]Limits{}
+	for name, l := range tables {
+		tableLimits[name] = l
+	}
+	for name, t := range cache {
+		t.SetLimits(limitsFor(name))
+	}
+}
+
+// limitsFor returns the limits of a table; the mutex of the store must be locked
+func limitsFor(name string) Limits {
+	if l, exists := tableLimits[name]; exists {
+		return l
+	}
+	return defaultLimits
+}
+
+// SetLimits changes the limits of the table,
+// and evicts the keys over the new limits
+func (c *CacheTable) SetLimits(l Limits) {
+	c.Lock()
+	defer c.Unlock()
+	c.limits = l
+	c.evict("")
+}
+
+// Stats returns the counters of the table
+func (c *CacheTable) Stats() Stats {
+	c.RLock()
+	defer c.RUnlock()
+	return Stats{
+		Items:     len(c.items),
+		Bytes:     c.bytes,
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+		Evictions: c.evictions,
+		Revision:  c.rev,
+		Limits:    c.limits,
+	}
+}
+
+// count updates the hits, or the misses
+func (c *CacheTable) count(hit bool) {
+	if hit {
+		atomic.AddUint64(&c.hits, 1)
+	} else {
+		atomic.AddUint64(&c.misses, 1)
+	}
+}
+
+// store saves the item, and keeps the size and the LRU order up to date;
+// the table must be locked
+func (c *CacheTable) store(key string, cacheItem item) {
+	if c.lru == nil {
+		c.lru = list.New()
+	}
+	if old, exists := c.items[key]; exists {
+		c.bytes -= old.size
+		c.lru.Remove(old.elem)
+	}
+	cacheItem.size = itemSize(key, cacheItem.value)
+	cacheItem.elem = c.lru.PushFront(key)
+	c.items[key] = cacheItem
+	c.bytes += cacheItem.size
+}
+
+// drop removes the item, and keeps the size and the LRU order up to date;
+// the table must be locked
+func (c *CacheTable) drop(key string) {
+	if old, exists := c.items[key]; exists {
+		c.bytes -= old.size
+		c.lru.Remove(old.elem)
+		delete(c.items, key)
+	}
+}
+
+// touch marks the key as recently used, only if the table is bounded
+func (c *CacheTable) touch(key string) {
+	c.RLock()
+	bounded := c.limits.bounded()
+	c.RUnlock()
+	if !bounded {
+		return
+	}
+	c.Lock()
+	if cacheItem, exists := c.items[key]; exists {
+		c.lru.MoveToFront(cacheItem.elem)
+	}
+	c.Unlock()
+}
+
+// evict deletes the keys until the table is within its limits,
+// without deleting the kept key; the table must be locked
+func (c *CacheTable) evict(keep string) {
+	l := c.limits
+	for (l.MaxItems > 0 && len(c.items) > l.MaxItems) || (l.MaxBytes > 0 && c.bytes > l.MaxBytes) {
+		key, found := c.victim(keep)
+		if !found {
+			return
+		}
+		c.delete(key)
+		c.evictions++
+	}
+}
+
+// victim returns the next key to evict; the table must be locked
+func (c *CacheTable) victim(keep string) (string, bool) {
+	if c.limits.Evict == EvictExpiry {
+		var first string
+		var expire int64
+		for key, it := range c.items {
+			if it.expire > 0 && key != keep && (expire == 0 || it.expire < expire) {
+				first, expire = key, it.expire
+			}
+		}
+		if expire > 0 {
+			return first, true
+		}
+	}
+	for e := c.lru.Back(); e != nil; e = e.Prev() {
+		if key := e.Value.(string); key != keep {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// itemSize estimates the memory used by one item
+func itemSize(key string, value interface{}) int64 {
+	size := int64(itemOverhead + len(key))
+	if data, err := json.Marshal(value); err == nil {
+		size += int64(len(data))
+	}
+	return size
+}
@@ -0,0 +1,150 @@
+package kvstore
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// Lock errors
+var (
+	ErrLocked  = errors.New("the lock is held by another holder")
+	ErrNoLease = errors.New("the lock is not held")
+)
+
+// Lease is a lock held by an owner (usually a SPIN_ID),
+// until it's released, or until it expires.
+type Lease struct {
+	Name     string    `json:"name"`
+	Owner    string    `json:"owner"`
+	Token    string    `json:"token,omitempty"` // proves the holder, to renew or release
+	Acquired time.Time `json:"acquired"`
+	Expires  time.Time `json:"expires"`
+}
+
+// The leases, by lock name; the expired leases are released by the TTL
+var leases = NewCache()
+
+// Acquire takes the lock for the owner, until the TTL expires.
+// The lock cannot be acquired twice, even by the same owner,
+// so the procs of one recipe exclude each other too.
+// If the lock is held, the current lease is returned, without its token.
+func Acquire(name, owner string, ttl time.Duration) (Lease, error) {
+	leases.Lock()
+	defer leases.Unlock()
+	if current, ok := leases.lookup(name); ok {
+		return public(current.value.(Lease)), ErrLocked
+	}
+	now := time.Now()
+	lease := Lease{Name: name, Owner: owner, Token: newToken(), Acquired: now, Expires: now.Add(ttl)}
+	leases.set(name, lease, ttl)
+	return lease, nil
+}
+
+// AcquireWait takes the lock like Acquire, waiting for the lock
+// to be released, or to expire, until the context is done.
+func AcquireWait(ctx context.Context, name, owner string, ttl time.Duration) (Lease, error) {
+	// The watcher receives the locks with the name as a prefix too
+	changes, stop := leases.Watch(name)
+	defer stop()
+	for {
+		lease, err := Acquire(name, owner, ttl)
+		if err != ErrLocked {
+			return lease, err
+		}
+		if !waitLease(ctx, name, lease, changes) {
+			return lease, err
+		}
+	}
+}
+
+// waitLease waits until the lock changes, or the lease expires;
+// returns false if the context is done first
+func waitLease(ctx context.Context, name string, lease Lease, changes <-chan Change) bool {
+	timer := time.NewTimer(time.Until(lease.Expires))
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case ch := <-changes:
+			if ch.Key == name {
+				return true
+			}
+		case <-timer.C:
+			return true
+		}
+	}
+}
+
+// Renew extends the lease with the TTL, from now
+func Renew(name, token string, ttl time.Duration) (Lease, error) {
+	leases.Lock()
+	defer leases.Unlock()
+	current, err := holding(name, token)
+	if err != nil {
+		return current, err
+	}
+	current.Expires = time.Now().Add(ttl)
+	leases.set(name, current, ttl)
+	return current, nil
+}
+
+// Release frees the lock, so it can be acquired by someone else
+func Release(name, token string) error {
+	leases.Lock()
+	defer leases.Unlock()
+	if _, err := holding(name, token); err != nil {
+		return err
+	}
+	leases.delete(name)
+	return nil
+}
+
+// GetLease returns the current lease of a lock, without its token
+func GetLease(name string) (Lease, bool) {
+	current, ok := leases.Get(name)
+	if !ok {
+		return Lease{}, false
+	}
+	return public(current.(Lease)), true
+}
+
+// Leases returns all the current leases, sorted by name, without their tokens
+func Leases() []Lease {
+	list := []Lease{}
+	for _, name := range leases.Keys("") {
+		if lease, ok := GetLease(name); ok {
+			list = append(list, lease)
+		}
+	}
+	return list
+}
+
+// holding returns the lease, if it's held with the token;
+// the leases must be locked
+func holding(name, token string) (Lease, error) {
+	current, ok := leases.lookup(name)
+	if !ok {
+		return Lease{}, ErrNoLease
+	}
+	lease := current.value.(Lease)
+	if lease.Token != token {
+		return public(lease), ErrLocked
+	}
+	return lease, nil
+}
+
+// public hides the token of a lease
+func public(lease Lease) Lease {
+	lease.Token = ""
+	return lease
+}
+
+func newToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,80 @@
+package kvstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocks(t *testing.T) {
+	assert := assert.New(t)
+
+	lease, err := Acquire("file", "spin1", time.Minute)
+	assert.Nil(err)
+	assert.Equal("spin1", lease.Owner)
+	assert.NotEmpty(lease.Token)
+
+	// Even the same owner cannot acquire it twice
+	current, err := Acquire("file", "spin1", time.Minute)
+	assert.Equal(ErrLocked, err)
+	assert.Equal("spin1", current.Owner)
+	assert.Empty(current.Token)
+	assert.Equal([]Lease{current}, Leases())
+
+	_, err = Renew("file", "wrong", time.Minute)
+	assert.Equal(ErrLocked, err)
+	renewed, err := Renew("file", lease.Token, timeUnit)
+	assert.Nil(err)
+	assert.True(renewed.Expires.Before(lease.Expires))
+
+	// Expired
+	time.Sleep(2 * timeUnit)
+	_, ok := GetLease("file")
+	assert.False(ok)
+	assert.Equal(ErrNoLease, Release("file", lease.Token))
+
+	// Wait for the release
+	lease, err = Acquire("file", "spin1", time.Minute)
+	assert.Nil(err)
+	go func() {
+		time.Sleep(timeUnit / 2)
+		assert.Equal(ErrLocked, Release("file", "wrong"))
+		assert.Nil(Release("file", lease.Token))
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*timeUnit)
+	defer cancel()
+	other, err := AcquireWait(ctx, "file", "spin2", time.Minute)
+	assert.Nil(err)
+	assert.Equal("spin2", other.Owner)
+
+	// Wait for the expiry, or give up
+	short, cancel2 := context.WithTimeout(context.Background(), timeUnit)
+	defer cancel2()
+	_, err = AcquireWait(short, "file", "spin3", time.Minute)
+	assert.Equal(ErrLocked, err)
+	Renew("file", other.Token, timeUnit)
+	_, err = AcquireWait(ctx, "file", "spin3", time.Minute)
+	assert.Nil(err)
+}
+
+func TestWaitLease(t *testing.T) {
+	assert := assert.New(t)
+	lease := Lease{Name: "file", Expires: time.Now().Add(time.Minute)}
+	changes := make(chan Change, 2)
+
+	// The locks with the name as a prefix are ignored
+	changes <- Change{Op: "set", Key: "file2"}
+	ctx, cancel := context.WithTimeout(context.Background(), timeUnit)
+	defer cancel()
+	assert.False(waitLease(ctx, "file", lease, changes))
+
+	changes <- Change{Op: "set", Key: "file2"}
+	changes <- Change{Op: "del", Key: "file"}
+	assert.True(waitLease(context.Background(), "file", lease, changes))
+
+	// Or until the lease expires
+	lease.Expires = time.Now().Add(timeUnit)
+	assert.True(waitLease(context.Background(), "file", lease, changes))
+}
@@ -0,0 +1,261 @@
+package kvstore
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The default visibility timeout of the popped messages
+const DefaultVisibility = 30 * time.Second
+
+// Pop errors
+var (
+	ErrNoMessage    = errors.New("there is no message in the queue")
+	ErrQueueDropped = errors.New("the queue was dropped")
+)
+
+// Message is one message from a queue, or a topic
+type Message struct {
+	ID       string      `json:"id"`
+	Body     interface{} `json:"body"`
+	Time     time.Time   `json:"time"`               // when it was pushed
+	Attempts int         `json:"attempts,omitempty"` // how many times it was popped
+	// Receipt identifies one delivery of the message; it's used to ack, or requeue
+	Receipt  string    `json:"receipt,omitempty"`
+	deadline time.Time // when the popped message becomes visible again
+}
+
+// QueueStats are the counters of a queue
+type QueueStats struct {
+	Ready    int    `json:"ready"`
+	Inflight int    `json:"inflight"`
+	Pushed   uint64 `json:"pushed"`
+	Acked    uint64 `json:"acked"`
+	Requeued uint64 `json:"requeued"` // requeued, or not acked in time
+}
+
+// Queue is a work queue: each message is popped by one consumer.
+// The popped message is hidden until it's acknowledged, or requeued,
+// or until the visibility timeout expires, when it's visible again.
+// The queues are kept in memory.
+type Queue struct {
+	sync.Mutex
+	ready    *list.List          // *Message, the oldest first
+	inflight map[string]*Message // popped messages, by receipt
+	wake     chan struct{}       // closed when messages are ready
+	lastID   uint64
+	stats    QueueStats
+	dropped  bool // the consumers stop waiting after the queue is dropped
+}
+
+var (
+	queues     = map[string]*Queue{}
+	queueMutex sync.RWMutex
+)
+
+// GetQueue returns the existing queue with given name,
+// or creates a new one if the queue doesn't exist yet.
+func GetQueue(name string) *Queue {
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+	q, ok := queues[name]
+	if !ok {
+		q = &Queue{ready: list.New(), inflight: map[string]*Message{}, wake: make(chan struct{})}
+		queues[name] = q
+	}
+	return q
+}
+
+// HasQueue checks if the queue exists, without creating it.
+func HasQueue(name string) bool {
+	queueMutex.RLock()
+	defer queueMutex.RUnlock()
+	_, ok := queues[name]
+	return ok
+}
+
+// DropQueue deletes the queue with all the messages,
+// and wakes up the consumers waiting for messages.
+// Returns false if the queue doesn't exist.
+func DropQueue(name string) bool {
+	queueMutex.Lock()
+	q, ok := queues[name]
+	delete(queues, name)
+	queueMutex.Unlock()
+	if !ok {
+		return false
+	}
+	q.Lock()
+	defer q.Unlock()
+	q.dropped = true
+	q.signal()
+	return true
+}
+
+// ListQueues returns the names of the queues, sorted
+func ListQueues() []string {
+	queueMutex.RLock()
+	names := []string{}
+	for name := range queues {
+		names = append(names, name)
+	}
+	queueMutex.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// Push adds a message at the end of the queue
+func (q *Queue) Push(body interface{}) Message {
+	q.Lock()
+	defer q.Unlock()
+	q.lastID++
+	m := &Message{ID: strconv.FormatUint(q.lastID, 10), Body: body, Time: time.Now()}
+	q.ready.PushBack(m)
+	q.stats.Pushed++
+	q.signal()
+	return *m
+}
+
+// Pop removes the first message from the queue, waiting for one until
+// the context is done. The message must be acknowledged with its receipt
+// before the visibility timeout, otherwise it's delivered again.
+// Returns ErrNoMessage if there was no message,
+// or ErrQueueDropped if the queue was dropped.
+func (q *Queue) Pop(ctx context.Context, visibility time.Duration) (Message, error) {
+	if visibility <= 0 {
+		visibility = DefaultVisibility
+	}
+	for {
+		q.Lock()
+		if q.dropped {
+			q.Unlock()
+			return Message{}, ErrQueueDropped
+		}
+		now := time.Now()
+		q.reclaim(now)
+		if e := q.ready.Front(); e != nil {
+			m := q.ready.Remove(e).(*Message)
+			m.Attempts++
+			m.Receipt = fmt.Sprintf("%s-%d", m.ID, m.Attempts)
+			m.deadline = now.Add(visibility)
+			q.inflight[m.Receipt] = m
+			q.Unlock()
+			return *m, nil
+		}
+		wake := q.wake
+		next := q.nextDeadline()
+		q.Unlock()
+
+		// Wait for a new message, or for a popped message to become visible
+		timer := time.NewTimer(visibility)
+		if !next.IsZero() {
+			timer.Reset(time.Until(next))
+		}
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return Message{}, ErrNoMessage
+		case <-wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// Ack deletes a popped message, by receipt.
+// Returns false if the receipt is unknown, or the visibility timeout expired.
+func (q *Queue) Ack(receipt string) bool {
+	q.Lock()
+	defer q.Unlock()
+	q.reclaim(time.Now())
+	if _, ok := q.inflight[receipt]; !ok {
+		return false
+	}
+	delete(q.inflight, receipt)
+	q.stats.Acked++
+	return true
+}
+
+// Requeue makes a popped message visible again, by receipt,
+// at the front of the queue.
+// Returns false if the receipt is unknown, or the visibility timeout expired.
+func (q *Queue) Requeue(receipt string) bool {
+	q.Lock()
+	defer q.Unlock()
+	q.reclaim(time.Now())
+	m, ok := q.inflight[receipt]
+	if !ok {
+		return false
+	}
+	q.putBack(m)
+	q.signal()
+	return true
+}
+
+// Stats returns the counters of the queue
+func (q *Queue) Stats() QueueStats {
+	q.Lock()
+	defer q.Unlock()
+	q.reclaim(time.Now())
+	stats := q.stats
+	stats.Ready = q.ready.Len()
+	stats.Inflight = len(q.inflight)
+	return stats
+}
+
+// reclaim makes visible the popped messages that were not acked in time;
+// the queue must be locked
+func (q *Queue) reclaim(now time.Time) {
+	expired := []*Message{}
+	for _, m := range q.inflight {
+		if !m.deadline.After(now) {
+			expired = append(expired, m)
+		}
+	}
+	if len(expired) == 0 {
+		return
+	}
+	// The oldest messages must be at the front
+	sort.Slice(expired, func(i, j int) bool {
+		return expired[i].Time.After(expired[j].Time)
+	})
+	for _, m := range expired {
+		q.putBack(m)
+	}
+	q.signal()
+}
+
+// putBack moves a popped message at the front of the queue;
+// the queue must be locked
+func (q *Queue) putBack(m *Message) {
+	delete(q.inflight, m.Receipt)
+	m.Receipt = ""
+	m.deadline = time.Time{}
+	q.ready.PushFront(m)
+	q.stats.Requeued++
+}
+
+// nextDeadline returns the first visibility deadline, or zero;
+// the queue must be locked
+func (q *Queue) nextDeadline() time.Time {
+	var next time.Time
+	for _, m := range q.inflight {
+		if next.IsZero() || m.deadline.Before(next) {
+			next = m.deadline
+		}
+	}
+	return next
+}
+
+// signal wakes up the consumers waiting for messages;
+// the queue must be locked
+func (q *Queue) signal() {
+	close(q.wake)
+	q.wake = make(chan struct{})
+}
@@ -0,0 +1,102 @@
+package kvstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueue(t *testing.T) {
+	assert := assert.New(t)
+	assert.False(HasQueue("jobs"))
+	q := GetQueue("jobs")
+	defer DropQueue("jobs")
+	assert.Equal([]string{"jobs"}, ListQueues())
+
+	q.Push("a")
+	q.Push("b")
+	ctx := context.Background()
+	m1, err := q.Pop(ctx, timeUnit)
+	assert.Nil(err)
+	assert.Equal("a", m1.Body)
+	assert.Equal(1, m1.Attempts)
+	m2, _ := q.Pop(ctx, time.Minute)
+	assert.Equal("b", m2.Body)
+	assert.Equal(QueueStats{Inflight: 2, Pushed: 2}, q.Stats())
+
+	// Nothing left; wait until the context is done
+	short, cancel := context.WithTimeout(ctx, timeUnit/2)
+	_, err = q.Pop(short, time.Minute)
+	cancel()
+	assert.Equal(ErrNoMessage, err)
+
+	// Not acked in time, so delivered again
+	m3, err := q.Pop(ctx, time.Minute)
+	assert.Nil(err)
+	assert.Equal(m1.ID, m3.ID)
+	assert.Equal(2, m3.Attempts)
+	assert.False(q.Ack(m1.Receipt))
+	assert.True(q.Ack(m3.Receipt))
+	assert.False(q.Ack(m3.Receipt))
+
+	// Requeued at the front
+	q.Push("c")
+	assert.True(q.Requeue(m2.Receipt))
+	m4, _ := q.Pop(ctx, time.Minute)
+	assert.Equal("b", m4.Body)
+
+	// A blocked consumer receives the new message
+	go func() {
+		time.Sleep(timeUnit / 2)
+		q.Push("d")
+	}()
+	q.Pop(ctx, time.Minute)
+	m5, err := q.Pop(ctx, time.Minute)
+	assert.Nil(err)
+	assert.Equal("d", m5.Body)
+	assert.Equal(QueueStats{Inflight: 3, Pushed: 4, Acked: 1, Requeued: 2}, q.Stats())
+
+	// A blocked consumer stops waiting when the queue is dropped
+	go func() {
+		time.Sleep(timeUnit / 2)
+		DropQueue("jobs")
+	}()
+	for {
+		if _, err = q.Pop(ctx, time.Minute); err != nil {
+			break
+		}
+	}
+	assert.Equal(ErrQueueDropped, err)
+	assert.False(HasQueue("jobs"))
+	assert.False(DropQueue("jobs"))
+}
+
+func TestTopic(t *testing.T) {
+	assert := assert.New(t)
+	topic := GetTopic("news")
+	assert.True(HasTopic("news"))
+
+	_, sent := topic.Publish("lost")
+	assert.Equal(0, sent)
+	ch1, stop1 := topic.Subscribe()
+	ch2, _ := topic.Subscribe()
+	m, sent := topic.Publish("hello")
+	assert.Equal(2, sent)
+	assert.Equal("2", m.ID)
+	assert.Equal("hello", (<-ch1).Body)
+	assert.Equal("hello", (<-ch2).Body)
+
+	stop1()
+	stop1()
+	_, sent = topic.Publish("bye")
+	assert.Equal(1, sent)
+	assert.Equal(TopicStats{Subscribers: 1, Published: 3}, topic.Stats())
+
+	assert.True(DropTopic("news"))
+	<-ch2
+	_, ok := <-ch2
+	assert.False(ok)
+	assert.Equal([]string{}, ListTopics())
+}
@@ -1,6 +1,8 @@
 package kvstore
 
 import (
+	"container/list"
+	"os"
 	"sync"
 )
 
@@ -31,7 +33,7 @@ func Store(table string) *CacheTable {
 		_, ok = cache[table]
 		// Double check whether the table exists or not.
 		if !ok {
-			cache[table] = &CacheTable{done: make(chan bool)}
+			cache[table] = newTable(table)
 		}
 		mutex.Unlock()
 	}
@@ -41,3 +43,47 @@ func Store(table string) *CacheTable {
 	t := cache[table]
 	return t
 }
+
+// Has checks if the table exists, without creating it.
+func Has(table string) bool {
+	_, ok := Lookup(table)
+	return ok
+}
+
+// Lookup returns the existing cache table with given name,
+// without creating it.
+func Lookup(table string) (*CacheTable, bool) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	t, ok := cache[table]
+	return t, ok
+}
+
+// Drop deletes the table with all the records;
+// in file mode, the files of the table are deleted too.
+// The writes into the dropped table fail, a new table is created by Store.
+// Returns false if the table doesn't exist.
+func Drop(table string) bool {
+	mutex.Lock()
+	t, ok := cache[table]
+	delete(cache, table)
+	mutex.Unlock()
+	if !ok {
+		return false
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	t.dropped = true
+	t.items = make(map[string]item)
+	t.lru = list.New()
+	t.bytes = 0
+	t.closeWatchers()
+	if t.journal != nil {
+		t.journal.file.Close()
+		os.Remove(t.journal.path + logExt)
+		os.Remove(t.journal.path + snapExt)
+		t.journal = nil
+	}
+	return true
+}
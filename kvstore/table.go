@@ -6,7 +6,10 @@
 package kvstore
 
 import (
+	"container/list"
 	"encoding/json"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -16,16 +19,30 @@ type CacheTable struct {
 	items        map[string]item
 	done         chan bool
 	cleanRunning bool
+	journal      *journal // nil in memory mode
+	rev          uint64   // the revision of the last change
+	watchers     map[*watcher]bool
+	limits       Limits
+	lru          *list.List // the keys, the most recently used first
+	bytes        int64      // the estimated size of the items
+	hits         uint64
+	misses       uint64
+	evictions    uint64
+	dropped      bool // the writes fail after the table is dropped
 }
 
 type item struct {
-	expire int64 // Unix micro
-	value  interface{}
+	expire  int64 // Unix micro
+	updated int64 // Unix micro, also the revision of the last change
+	value   interface{}
+	size    int64         // estimated
+	elem    *list.Element // the position in the LRU list
 }
 
 func NewCache() *CacheTable {
 	return &CacheTable{
 		items: make(map[string]item),
+		lru:   list.New(),
 		done:  make(chan bool),
 	}
 }
@@ -44,7 +61,9 @@ func (c *CacheTable) get(key string) (item, bool) {
 	}
 	if cacheItem.expire > 0 && cacheItem.expire < time.Now().UnixMicro() {
 		c.Lock()
-		delete(c.items, key)
+		if c.items[key].expire == cacheItem.expire {
+			c.drop(key)
+		}
 		c.Unlock()
 		return item{}, false
 	}
@@ -61,12 +80,38 @@ func (c *CacheTable) Exists(key string) bool {
 // Second returned: existence flag like in the map.
 func (c *CacheTable) Get(key string) (interface{}, bool) {
 	cacheItem, ok := c.get(key)
+	c.count(ok)
+	if ok {
+		c.touch(key)
+	}
 	return cacheItem.value, ok
 }
 
+// Updated returns the last time the record was set.
+// Second returned: existence flag like in the map.
+func (c *CacheTable) Updated(key string) (time.Time, bool) {
+	cacheItem, ok := c.get(key)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.UnixMicro(cacheItem.updated), true
+}
+
 // Set adds record in the cache with given ttl.
 // If TTL is less than zero, it will be stored forever.
-func (c *CacheTable) Set(key string, value interface{}, ttl time.Duration) {
+// Returns ErrDropped if the table was dropped.
+func (c *CacheTable) Set(key string, value interface{}, ttl time.Duration) error {
+	c.Lock()
+	defer c.Unlock()
+	if c.dropped {
+		return ErrDropped
+	}
+	c.set(key, value, ttl)
+	return nil
+}
+
+// internal set; the table must be locked
+func (c *CacheTable) set(key string, value interface{}, ttl time.Duration) {
 	cacheItem := item{value: value}
 	if ttl == 0 {
 		cacheItem.expire = 0
@@ -75,16 +120,64 @@ func (c *CacheTable) Set(key string, value interface{}, ttl time.Duration) {
 	} else {
 		cacheItem.expire = time.Now().Add(ttl).UnixMicro()
 	}
-	c.Lock()
-	c.items[key] = cacheItem
-	c.Unlock()
+	c.put(key, cacheItem)
+}
+
+// put stores the item as a new revision, writes the change in the log,
+// and notifies the watchers; the table must be locked
+func (c *CacheTable) put(key string, cacheItem item) {
+	rev := c.nextRev()
+	cacheItem.updated = int64(rev)
+	c.store(key, cacheItem)
+	c.write(record{Op: "set", Key: key, Value: cacheItem.value,
+		Expire: cacheItem.expire, Updated: cacheItem.updated})
+	c.notify(Change{Rev: rev, Op: "set", Key: key, Value: cacheItem.value})
+	c.evict(key)
+}
+
+// Keys returns the keys that start with the prefix, sorted,
+// without the expired keys.
+func (c *CacheTable) Keys(prefix string) []string {
+	now := time.Now().UnixMicro()
+	keys := []string{}
+	c.RLock()
+	for key, item := range c.items {
+		if item.expire > 0 && item.expire < now {
+			continue
+		}
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	c.RUnlock()
+	sort.Strings(keys)
+	return keys
 }
 
 // Delete deletes the key and its value from the cache.
-func (c *CacheTable) Delete(key string) {
+// Returns ErrDropped if the table was dropped.
+func (c *CacheTable) Delete(key string) error {
 	c.Lock()
 	defer c.Unlock()
-	delete(c.items, key)
+	if c.dropped {
+		return ErrDropped
+	}
+	c.delete(key)
+	return nil
+}
+
+// internal delete; the table must be locked.
+// Only the removed keys are written in the log.
+func (c *CacheTable) delete(key string) {
+	_, existed := c.lookup(key)
+	if _, stored := c.items[key]; !stored {
+		return
+	}
+	c.drop(key)
+	c.write(record{Op: "del", Key: key})
+	if existed {
+		c.notify(Change{Rev: c.nextRev(), Op: "del", Key: key})
+	}
 }
 
 // Count returns how many items are currently stored in the cache.
@@ -102,7 +195,7 @@ func (c *CacheTable) cleanUp() {
 
 	for key, item := range c.items {
 		if item.expire > 0 && item.expire < now {
-			delete(c.items, key)
+			c.drop(key)
 		}
 	}
 }
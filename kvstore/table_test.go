@@ -1,6 +1,7 @@
 package kvstore
 
 import (
+	"context"
 	"testing"
 	"time"
 
@@ -56,3 +57,208 @@ func TestTableNoTTL(t *testing.T) {
 	assert.Equal(2, table.Count())
 	assert.True(table.Exists("y"))
 }
+
+func TestTableUpdated(t *testing.T) {
+	assert := assert.New(t)
+
+	table := Store("health")
+	_, ok := table.Updated("x")
+	assert.False(ok)
+
+	before := time.Now()
+	table.Set("x", 1, -1)
+	updated, ok := table.Updated("x")
+	assert.True(ok)
+	assert.False(updated.Before(before.Truncate(time.Microsecond)))
+	assert.True(time.Since(updated) < timeUnit)
+}
+
+func TestTableKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	table := NewCache()
+	assert.Equal([]string{}, table.Keys(""))
+	table.Set("user:2", 2, -1)
+	table.Set("user:1", 1, -1)
+	table.Set("item:1", 1, -1)
+	table.Set("user:3", 3, timeUnit)
+	assert.Equal([]string{"item:1", "user:1", "user:2", "user:3"}, table.Keys(""))
+	assert.Equal([]string{"user:1", "user:2", "user:3"}, table.Keys("user:"))
+
+	time.Sleep(2 * timeUnit)
+	assert.Equal([]string{"user:1", "user:2"}, table.Keys("user:"))
+}
+
+func TestDropTable(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.False(Has("drop"))
+	assert.False(Drop("drop"))
+	_, exists := Lookup("drop")
+	assert.False(exists)
+	assert.False(Has("drop"))
+	table := Store("drop")
+	assert.Nil(table.Set("x", 1, -1))
+	assert.True(Has("drop"))
+	assert.True(Drop("drop"))
+	assert.False(Has("drop"))
+
+	// The writes into the dropped table fail
+	assert.Equal(ErrDropped, table.Set("x", 1, -1))
+	assert.Equal(ErrDropped, table.Delete("x"))
+	_, err := table.Increment("n", 1, -1)
+	assert.Equal(ErrDropped, err)
+	assert.Equal(ErrDropped, table.Batch([]Op{{Op: OpSet, Key: "x", Value: 1}}))
+	_, ok := table.SetIfAbsent("x", 1, -1)
+	assert.False(ok)
+	assert.False(table.Exists("x"))
+	assert.False(Store("drop").Exists("x"))
+	Drop("drop")
+}
+
+func TestAtomicOps(t *testing.T) {
+	assert := assert.New(t)
+	table := NewCache()
+
+	// Compare and swap
+	_, ok := table.CompareAndSwap("leader", nil, "a", -1)
+	assert.False(ok)
+	v, ok := table.SetIfAbsent("leader", "a", -1)
+	assert.True(ok)
+	assert.Equal("a", v)
+	v, ok = table.SetIfAbsent("leader", "b", -1)
+	assert.False(ok)
+	assert.Equal("a", v)
+	v, ok = table.CompareAndSwap("leader", "b", "c", -1)
+	assert.False(ok)
+	assert.Equal("a", v)
+	_, ok = table.CompareAndSwap("leader", "a", "c", -1)
+	assert.True(ok)
+	v, _ = table.Get("leader")
+	assert.Equal("c", v)
+
+	// Increment
+	n, err := table.Increment("counter", 2, timeUnit)
+	assert.Nil(err)
+	assert.Equal(2.0, n)
+	n, _ = table.Increment("counter", -0.5, -1)
+	assert.Equal(1.5, n)
+	table.Set("int", 5, -1)
+	n, _ = table.Increment("int", 1, -1)
+	assert.Equal(6.0, n)
+	_, err = table.Increment("leader", 1, -1)
+	assert.Equal(ErrNotNumber, err)
+	// The counter keeps its expiry time
+	time.Sleep(2 * timeUnit)
+	assert.False(table.Exists("counter"))
+
+	// Batch
+	assert.NotNil(table.Batch([]Op{{Op: "get", Key: "x"}}))
+	assert.Nil(table.Batch([]Op{
+		{Op: OpSet, Key: "x", Value: 1, TTL: -1},
+		{Op: OpSet, Key: "y", Value: 2, TTL: -1},
+		{Op: OpDelete, Key: "leader"},
+	}))
+	assert.Equal([]string{"int", "x", "y"}, table.Keys(""))
+}
+
+func TestWatch(t *testing.T) {
+	assert := assert.New(t)
+	table := NewCache()
+
+	changes, stop := table.Watch("job:")
+	table.Set("other", 1, -1)
+	table.Set("job:1", "new", -1)
+	table.Delete("job:1")
+	table.Delete("job:2") // missing, no change
+
+	set := <-changes
+	assert.Equal("set", set.Op)
+	assert.Equal("job:1", set.Key)
+	assert.Equal("new", set.Value)
+	del := <-changes
+	assert.Equal("del", del.Op)
+	assert.True(del.Rev > set.Rev)
+	assert.Equal(del.Rev, table.Revision())
+	assert.Equal(0, len(changes))
+	stop()
+	stop()
+	_, ok := <-changes
+	assert.False(ok)
+
+	// Long-poll
+	table.Set("x", 1, -1)
+	_, rev, ok := table.GetRevision("x")
+	assert.True(ok)
+	assert.True(table.Wait(context.Background(), "x", rev-1))
+	ctx, cancel := context.WithTimeout(context.Background(), timeUnit)
+	assert.False(table.Wait(ctx, "x", rev))
+	cancel()
+
+	go func() {
+		time.Sleep(timeUnit / 2)
+		table.Set("y", 2, -1)
+		table.Set("x", 2, -1)
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 10*timeUnit)
+	defer cancel()
+	assert.True(table.Wait(ctx, "x", rev))
+	v, newRev, _ := table.GetRevision("x")
+	assert.Equal(2, v)
+	assert.True(newRev > rev)
+
+	// The revision alone is not counted as a hit or a miss
+	stats := table.Stats()
+	assert.Equal(newRev, table.KeyRevision("x"))
+	assert.Equal(table.Revision(), table.KeyRevision("missing"))
+	assert.Equal(stats, table.Stats())
+}
+
+func TestLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	// LRU eviction, by items
+	table := NewCache()
+	table.SetLimits(Limits{MaxItems: 3})
+	table.Set("a", 1, -1)
+	table.Set("b", 2, -1)
+	table.Set("c", 3, -1)
+	table.Get("a")
+	table.Get("x")
+	table.Set("d", 4, -1)
+	assert.Equal([]string{"a", "c", "d"}, table.Keys(""))
+	stats := table.Stats()
+	assert.Equal(3, stats.Items)
+	assert.Equal(uint64(1), stats.Hits)
+	assert.Equal(uint64(1), stats.Misses)
+	assert.Equal(uint64(1), stats.Evictions)
+	assert.Equal(int64(3*(itemOverhead+2)), stats.Bytes)
+
+	// Lower limits evict immediately
+	table.SetLimits(Limits{MaxBytes: 2 * (itemOverhead + 2)})
+	assert.Equal([]string{"a", "d"}, table.Keys(""))
+	table.Delete("a")
+	assert.Equal(int64(itemOverhead+2), table.Stats().Bytes)
+
+	// Expiry eviction, the keys that expire first
+	table = NewCache()
+	table.SetLimits(Limits{MaxItems: 2, Evict: EvictExpiry})
+	table.Set("a", 1, time.Hour)
+	table.Set("b", 2, time.Minute)
+	table.Set("c", 3, -1)
+	assert.Equal([]string{"a", "c"}, table.Keys(""))
+	table.Set("d", 4, -1)
+	assert.Equal([]string{"c", "d"}, table.Keys(""))
+
+	// Default limits, for the new tables
+	SetDefaultLimits(Limits{MaxItems: 1}, map[string]Limits{"big": {}})
+	defer SetDefaultLimits(Limits{}, nil)
+	Store("small").Set("a", 1, -1)
+	Store("small").Set("b", 2, -1)
+	assert.Equal(1, Store("small").Count())
+	Store("big").Set("a", 1, -1)
+	Store("big").Set("b", 2, -1)
+	assert.Equal(2, Store("big").Count())
+	Drop("small")
+	Drop("big")
+}
@@ -0,0 +1,127 @@
+package kvstore
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How many messages can wait for a slow subscriber, before they are dropped
+const topicBuffer = 100
+
+// TopicStats are the counters of a topic
+type TopicStats struct {
+	Subscribers int    `json:"subscribers"`
+	Published   uint64 `json:"published"`
+}
+
+// Topic is a pub/sub channel: each message is sent to all the subscribers.
+// The messages are not stored; without subscribers, they are lost.
+type Topic struct {
+	sync.Mutex
+	subs   map[chan Message]bool
+	lastID uint64
+}
+
+var (
+	topics     = map[string]*Topic{}
+	topicMutex sync.RWMutex
+)
+
+// GetTopic returns the existing topic with given name,
+// or creates a new one if the topic doesn't exist yet.
+func GetTopic(name string) *Topic {
+	topicMutex.Lock()
+	defer topicMutex.Unlock()
+	t, ok := topics[name]
+	if !ok {
+		t = &Topic{subs: map[chan Message]bool{}}
+		topics[name] = t
+	}
+	return t
+}
+
+// HasTopic checks if the topic exists, without creating it.
+func HasTopic(name string) bool {
+	topicMutex.RLock()
+	defer topicMutex.RUnlock()
+	_, ok := topics[name]
+	return ok
+}
+
+// DropTopic deletes the topic; the subscribers are closed.
+// Returns false if the topic doesn't exist.
+func DropTopic(name string) bool {
+	topicMutex.Lock()
+	t, ok := topics[name]
+	delete(topics, name)
+	topicMutex.Unlock()
+	if !ok {
+		return false
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	for ch := range t.subs {
+		close(ch)
+	}
+	t.subs = map[chan Message]bool{}
+	return true
+}
+
+// ListTopics returns the names of the topics, sorted
+func ListTopics() []string {
+	topicMutex.RLock()
+	names := []string{}
+	for name := range topics {
+		names = append(names, name)
+	}
+	topicMutex.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// Publish sends a message to all the subscribers, without blocking.
+// Returns the message, and how many subscribers received it.
+func (t *Topic) Publish(body interface{}) (Message, int) {
+	t.Lock()
+	defer t.Unlock()
+	t.lastID++
+	m := Message{ID: strconv.FormatUint(t.lastID, 10), Body: body, Time: time.Now()}
+	sent := 0
+	for ch := range t.subs {
+		select {
+		case ch <- m:
+			sent++
+		default:
+		}
+	}
+	return m, sent
+}
+
+// Subscribe returns a channel that receives the new messages,
+// and a function to unsubscribe. The messages are dropped
+// when the subscriber is too slow.
+// The channel is closed when the topic is dropped.
+func (t *Topic) Subscribe() (<-chan Message, func()) {
+	ch := make(chan Message, topicBuffer)
+	t.Lock()
+	t.subs[ch] = true
+	t.Unlock()
+	return ch, func() {
+		t.Lock()
+		defer t.Unlock()
+		if t.subs[ch] {
+			delete(t.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Stats returns the counters of the topic
+func (t *Topic) Stats() TopicStats {
+	t.Lock()
+	defer t.Unlock()
+	return TopicStats{Subscribers: len(t.subs), Published: t.lastID}
+}
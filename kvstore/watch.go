@@ -0,0 +1,157 @@
+package kvstore
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// How many changes can wait for a slow watcher, before they are dropped
+const watchBuffer = 100
+
+// Change is one change of a key, sent to the watchers.
+// The expired keys don't produce changes.
+type Change struct {
+	Rev   uint64      `json:"rev"`
+	Op    string      `json:"op"` // set, or del
+	Key   string      `json:"key"`
+	Value interface{} `json:"value,omitempty"`
+	Time  time.Time   `json:"time"`
+}
+
+// watcher receives the changes of the keys that start with the prefix
+type watcher struct {
+	prefix string
+	ch     chan Change
+}
+
+// nextRev returns the revision of a new change; the table must be locked.
+// The revisions are derived from the Unix time in microseconds,
+// so they keep increasing after a restart, in file mode.
+func (c *CacheTable) nextRev() uint64 {
+	rev := uint64(time.Now().UnixMicro())
+	if rev <= c.rev {
+		rev = c.rev + 1
+	}
+	c.rev = rev
+	return rev
+}
+
+// notify sends a change to the watchers, without blocking;
+// the table must be locked
+func (c *CacheTable) notify(ch Change) {
+	if len(c.watchers) == 0 {
+		return
+	}
+	ch.Time = time.UnixMicro(int64(ch.Rev))
+	for w := range c.watchers {
+		if !strings.HasPrefix(ch.Key, w.prefix) {
+			continue
+		}
+		select {
+		case w.ch <- ch:
+		default:
+		}
+	}
+}
+
+// Revision returns the revision of the last change in the table
+func (c *CacheTable) Revision() uint64 {
+	c.RLock()
+	defer c.RUnlock()
+	return c.rev
+}
+
+// KeyRevision returns the revision of the last change of a key,
+// without counting a hit or a miss.
+// For a missing key, the revision of the table is returned.
+func (c *CacheTable) KeyRevision(key string) uint64 {
+	_, rev, _ := c.getRevision(key)
+	return rev
+}
+
+// GetRevision returns the stored value and the revision of its last change.
+// For a missing key, the revision of the table is returned.
+func (c *CacheTable) GetRevision(key string) (interface{}, uint64, bool) {
+	cacheItem, rev, ok := c.getRevision(key)
+	c.count(ok)
+	if ok {
+		c.touch(key)
+	}
+	return cacheItem.value, rev, ok
+}
+
+// internal get, with the revision of the key, or of the table
+func (c *CacheTable) getRevision(key string) (item, uint64, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	cacheItem, ok := c.lookup(key)
+	rev := c.rev
+	if ok {
+		rev = uint64(cacheItem.updated)
+	}
+	return cacheItem, rev, ok
+}
+
+// Watch returns a channel that receives the changes of the keys
+// that start with the prefix, and a function to stop watching.
+// The changes are dropped when the watcher is too slow.
+// The channel is closed when the table is dropped.
+func (c *CacheTable) Watch(prefix string) (<-chan Change, func()) {
+	c.Lock()
+	defer c.Unlock()
+	return c.watch(prefix)
+}
+
+// internal watch; the table must be locked
+func (c *CacheTable) watch(prefix string) (<-chan Change, func()) {
+	w := &watcher{prefix: prefix, ch: make(chan Change, watchBuffer)}
+	if c.watchers == nil {
+		c.watchers = map[*watcher]bool{}
+	}
+	c.watchers[w] = true
+	return w.ch, func() {
+		c.Lock()
+		defer c.Unlock()
+		if c.watchers[w] {
+			delete(c.watchers, w)
+			close(w.ch)
+		}
+	}
+}
+
+// closeWatchers stops all the watchers; the table must be locked
+func (c *CacheTable) closeWatchers() {
+	for w := range c.watchers {
+		close(w.ch)
+	}
+	c.watchers = nil
+}
+
+// Wait blocks until the key changes after the given revision,
+// or until the context is done.
+// Returns true if the key changed; a missing key is waited for until it's set.
+func (c *CacheTable) Wait(ctx context.Context, key string, rev uint64) bool {
+	c.Lock()
+	if cacheItem, ok := c.lookup(key); ok && uint64(cacheItem.updated) > rev {
+		c.Unlock()
+		return true
+	}
+	changes, stop := c.watch(key)
+	c.Unlock()
+	defer stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case ch, ok := <-changes:
+			if !ok {
+				return false
+			}
+			if ch.Key == key && ch.Rev > rev {
+				return true
+			}
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package limits
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// The cgroup period of the CPU quota, in microseconds
+const cpuPeriod = 100000
+
+// The folder of the procs cgroups, under the parent cgroup
+const cgroupPrefix = "spinal"
+
+// The leaf cgroup of the Spinal process, under its own cgroup
+const cgroupMain = "spinal-main"
+
+// The controllers enabled for the procs cgroups
+var controllers = []string{"memory", "cpu", "pids"}
+
+// The files describing the cgroup of the current process
+var (
+	procCgroup    = "/proc/self/cgroup"
+	procMountinfo = "/proc/self/mountinfo"
+)
+
+var (
+	cgroupParent string
+	cgroupRoot   string
+	cgroupErr    error
+	cgroupOnce   sync.Once
+	// The changes made in the parent cgroup, undone by CgroupCleanup
+	cgroupMoved   string   // the leaf cgroup, if the processes were moved
+	cgroupEnabled []string // the controllers enabled by Spinal, as "dir:name"
+)
+
+// SetCgroupParent changes the parent cgroup, before the first cgroup
+// is created; it should be a cgroup delegated to Spinal, eg: by systemd.
+// By default, it's the cgroup of the Spinal process, used only if
+// Spinal is the only process in it.
+func SetCgroupParent(dir string) {
+	cgroupParent = dir
+}
+
+// CgroupRoot returns the folder of the procs cgroups, after enabling
+// the controllers; returns an error if cgroup v2 is not available, or not writable.
+// The processes of the parent cgroup are moved into a leaf cgroup, because
+// only the cgroups without processes can enable controllers; by default,
+// the cgroup of Spinal is not changed if it has other processes.
+func CgroupRoot() (string, error) {
+	cgroupOnce.Do(func() {
+		parent := cgroupParent
+		if parent == "" {
+			if parent, cgroupErr = selfCgroup(); cgroupErr != nil {
+				return
+			}
+			if cgroupErr = onlySelf(parent); cgroupErr != nil {
+				return
+			}
+		}
+		if cgroupErr = delegate(parent); cgroupErr != nil {
+			return
+		}
+		if cgroupErr = enableControllers(parent); cgroupErr != nil {
+			return
+		}
+		root := filepath.Join(parent, cgroupPrefix)
+		if err := os.Mkdir(root, 0755); err != nil && !os.IsExist(err) {
+			cgroupErr = err
+			return
+		}
+		if cgroupErr = enableControllers(root); cgroupErr == nil {
+			cgroupRoot = root
+		}
+	})
+	return cgroupRoot, cgroupErr
+}
+
+// CgroupCleanup undoes the changes of CgroupRoot in the parent cgroup:
+// deletes the folder of the procs cgroups, disables the controllers,
+// and moves the processes back; the procs cgroups must be removed
+func CgroupCleanup() error {
+	errs := []string{}
+	if cgroupRoot != "" {
+		if err := os.Remove(cgroupRoot); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	// The processes can move back only after the controllers are disabled
+	for i := len(cgroupEnabled) - 1; i >= 0; i-- {
+		dir, name := filepath.Dir(cgroupEnabled[i]), filepath.Base(cgroupEnabled[i])
+		if dir == cgroupRoot {
+			continue
+		}
+		ctl := filepath.Join(dir, "cgroup.subtree_control")
+		if err := os.WriteFile(ctl, []byte("-"+name), 0644); err != nil {
+			errs = append(errs, fmt.Sprintf("cannot disable the cgroup controller '%s': %v", name, err))
+		}
+	}
+	if cgroupMoved != "" {
+		if err := movePids(cgroupMoved, filepath.Dir(cgroupMoved)); err != nil {
+			errs = append(errs, err.Error())
+		} else if err := os.Remove(cgroupMoved); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	cgroupRoot, cgroupMoved, cgroupEnabled = "", "", nil
+	cgroupErr, cgroupOnce = nil, sync.Once{}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// NewCgroup creates the cgroup of one proc, or updates it if it exists
+func NewCgroup(name string, l CgroupLimits) (*Cgroup, error) {
+	root, err := CgroupRoot()
+	if err != nil {
+		return nil, err
+	}
+	cg := &Cgroup{Dir: filepath.Join(root, name)}
+	if err := os.Mkdir(cg.Dir, 0755); err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+
+	memory, cpu, pids := "max", fmt.Sprintf("max %d", cpuPeriod), "max"
+	if l.Memory > 0 {
+		memory = strconv.FormatInt(l.Memory, 10)
+	}
+	if l.CPU > 0 {
+		cpu = fmt.Sprintf("%d %d", int64(l.CPU*cpuPeriod), cpuPeriod)
+	}
+	if l.Procs > 0 {
+		pids = strconv.FormatUint(l.Procs, 10)
+	}
+	for _, f := range [][2]string{{"memory.max", memory}, {"cpu.max", cpu}, {"pids.max", pids}} {
+		if err := cg.write(f[0], f[1]); err != nil {
+			cg.Remove()
+			return nil, err
+		}
+	}
+	// Without swap, the procs over the memory limit are killed, instead of swapping;
+	// the swap controller might not be enabled
+	if l.Memory > 0 {
+		cg.write("memory.swap.max", "0")
+	}
+	cg.ooms = cg.oomKills()
+	return cg, nil
+}
+
+// OOMKilled returns true if the OOM killer killed a proc
+// since the previous call
+func (cg *Cgroup) OOMKilled() bool {
+	current := cg.oomKills()
+	killed := current > cg.ooms
+	cg.ooms = current
+	return killed
+}
+
+// Remove deletes the cgroup; the procs must be stopped
+func (cg *Cgroup) Remove() error {
+	return os.Remove(cg.Dir)
+}
+
+func (cg *Cgroup) write(fname string, value string) error {
+	return os.WriteFile(filepath.Join(cg.Dir, fname), []byte(value), 0644)
+}
+
+// oomKills returns the number of procs killed by the OOM killer
+func (cg *Cgroup) oomKills() uint64 {
+	data, err := os.ReadFile(filepath.Join(cg.Dir, "memory.events"))
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "oom_kill ") {
+			n, _ := strconv.ParseUint(strings.TrimPrefix(line, "oom_kill "), 10, 64)
+			return n
+		}
+	}
+	return 0
+}
+
+// selfCgroup returns the folder of the cgroup of the current process
+func selfCgroup() (string, error) {
+	mount, err := cgroup2Mount()
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(procCgroup)
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			return filepath.Join(mount, strings.TrimPrefix(line, "0::")), nil
+		}
+	}
+	return "", errors.New("cgroup v2 is not available")
+}
+
+// onlySelf returns an error if the cgroup has other processes than Spinal,
+// eg: the shell of the user, or other services
+func onlySelf(dir string) error {
+	pids, err := cgroupPids(dir)
+	if err != nil {
+		return err
+	}
+	self := strconv.Itoa(os.Getpid())
+	for _, pid := range pids {
+		if pid != self {
+			return fmt.Errorf("the cgroup %s has other processes; set the cgroup_dir to a delegated cgroup", dir)
+		}
+	}
+	return nil
+}
+
+// delegate moves the processes of a cgroup into its leaf cgroup,
+// so the cgroup can enable the controllers for its children
+func delegate(dir string) error {
+	pids, err := cgroupPids(dir)
+	if err != nil || len(pids) == 0 {
+		return err
+	}
+	leaf := filepath.Join(dir, cgroupMain)
+	if err := os.Mkdir(leaf, 0755); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("cannot create the cgroup %s: %v", leaf, err)
+	}
+	cgroupMoved = leaf
+	return movePids(dir, leaf)
+}
+
+// movePids moves all the processes of a cgroup into another cgroup
+func movePids(from string, to string) error {
+	pids, err := cgroupPids(from)
+	if err != nil {
+		return err
+	}
+	// One process per write
+	for _, pid := range pids {
+		err := os.WriteFile(filepath.Join(to, "cgroup.procs"), []byte(pid), 0644)
+		// The process might have exited meanwhile
+		if err != nil && !errors.Is(err, syscall.ESRCH) {
+			return fmt.Errorf("cannot move the process %s into %s: %v", pid, to, err)
+		}
+	}
+	return nil
+}
+
+// cgroupPids returns the processes of a cgroup
+func cgroupPids(dir string) ([]string, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "cgroup.procs"))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the cgroup processes: %v", err)
+	}
+	return strings.Fields(string(data)), nil
+}
+
+// cgroup2Mount returns the mount point of the cgroup v2 hierarchy
+func cgroup2Mount() (string, error) {
+	f, err := os.Open(procMountinfo)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// The file system type follows the separator, eg:
+		// 30 23 0:26 / /sys/fs/cgroup rw,nosuid shared:4 - cgroup2 cgroup2 rw
+		fields := strings.Fields(scanner.Text())
+		for i, field := range fields {
+			if field == "-" && i+1 < len(fields) && fields[i+1] == "cgroup2" && len(fields) > 4 {
+				return fields[4], nil
+			}
+		}
+	}
+	return "", errors.New("cgroup v2 is not mounted")
+}
+
+// enableControllers enables the controllers for the children of a cgroup,
+// and remembers the ones that were not enabled before;
+// the cgroups with processes cannot enable controllers, except the root
+func enableControllers(dir string) error {
+	data, err := os.ReadFile(filepath.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		return fmt.Errorf("cgroup v2 is not available: %v", err)
+	}
+	available := strings.Fields(string(data))
+	data, _ = os.ReadFile(filepath.Join(dir, "cgroup.subtree_control"))
+	enabled := strings.Fields(string(data))
+	for _, name := range controllers {
+		if !contains(available, name) {
+			return fmt.Errorf("the cgroup controller '%s' is not available in %s", name, dir)
+		}
+		if contains(enabled, name) {
+			continue
+		}
+		ctl := filepath.Join(dir, "cgroup.subtree_control")
+		if err := os.WriteFile(ctl, []byte("+"+name), 0644); err != nil {
+			return fmt.Errorf("cannot enable the cgroup controller '%s': %v", name, err)
+		}
+		cgroupEnabled = append(cgroupEnabled, filepath.Join(dir, name))
+	}
+	return nil
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package limits
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCgroup(t *testing.T) {
+	assert := assert.New(t)
+
+	// A folder that looks like a cgroup v2 parent
+	parent := t.TempDir()
+	root := filepath.Join(parent, cgroupPrefix)
+	assert.Nil(os.Mkdir(root, 0755))
+	for _, dir := range []string{parent, root} {
+		assert.Nil(os.WriteFile(filepath.Join(dir, "cgroup.controllers"), []byte("cpu memory pids\n"), 0644))
+	}
+	// A delegated cgroup, without processes
+	assert.Nil(os.WriteFile(filepath.Join(parent, "cgroup.procs"), []byte(""), 0644))
+	SetCgroupParent(parent)
+	defer SetCgroupParent("")
+
+	dir, err := CgroupRoot()
+	assert.Nil(err)
+	assert.Equal(root, dir)
+	ctl, _ := os.ReadFile(filepath.Join(root, "cgroup.subtree_control"))
+	assert.Equal("+pids", string(ctl))
+
+	cg, err := NewCgroup("app.sh", CgroupLimits{Memory: 64 << 20, CPU: 0.5})
+	assert.Nil(err)
+	assert.Equal(filepath.Join(root, "app.sh"), cg.Dir)
+	for fname, value := range map[string]string{
+		"memory.max": "67108864", "memory.swap.max": "0", "cpu.max": "50000 100000", "pids.max": "max",
+	} {
+		data, _ := os.ReadFile(filepath.Join(cg.Dir, fname))
+		assert.Equal(value, string(data), fname)
+	}
+
+	assert.False(cg.OOMKilled())
+	events := "low 0\nhigh 0\nmax 3\noom 1\noom_kill 1\n"
+	assert.Nil(os.WriteFile(filepath.Join(cg.Dir, "memory.events"), []byte(events), 0644))
+	assert.True(cg.OOMKilled())
+	assert.False(cg.OOMKilled())
+
+	// A real cgroup folder has only virtual files
+	os.RemoveAll(cg.Dir)
+	assert.NotNil(cg.Remove())
+}
+
+func TestCgroupDelegate(t *testing.T) {
+	assert := assert.New(t)
+	defer func(cgroup, mountinfo string) {
+		procCgroup, procMountinfo = cgroup, mountinfo
+		CgroupCleanup()
+	}(procCgroup, procMountinfo)
+	CgroupCleanup()
+
+	// The Spinal process runs in its own cgroup, eg: a systemd service
+	mount := t.TempDir()
+	mine := filepath.Join(mount, "system.slice", "spinal.service")
+	root := filepath.Join(mine, cgroupPrefix)
+	assert.Nil(os.MkdirAll(root, 0755))
+	for _, dir := range []string{mine, root} {
+		assert.Nil(os.WriteFile(filepath.Join(dir, "cgroup.controllers"), []byte("cpu memory pids\n"), 0644))
+	}
+
+	procCgroup = filepath.Join(t.TempDir(), "cgroup")
+	procMountinfo = filepath.Join(t.TempDir(), "mountinfo")
+	assert.Nil(os.WriteFile(procCgroup, []byte("0::/system.slice/spinal.service\n"), 0644))
+	mountinfo := "30 23 0:26 / " + mount + " rw,nosuid shared:4 - cgroup2 cgroup2 rw\n"
+	assert.Nil(os.WriteFile(procMountinfo, []byte(mountinfo), 0644))
+
+	self := strconv.Itoa(os.Getpid())
+	procsFile := filepath.Join(mine, "cgroup.procs")
+	ctlFile := filepath.Join(mine, "cgroup.subtree_control")
+
+	// The cgroup with other processes, eg: the shell of the user, is not changed
+	assert.Nil(os.WriteFile(procsFile, []byte(self+"\n123\n"), 0644))
+	_, err := CgroupRoot()
+	assert.NotNil(err)
+	assert.NoDirExists(filepath.Join(mine, cgroupMain))
+	assert.NoFileExists(ctlFile)
+	assert.Nil(CgroupCleanup())
+
+	// Spinal is the only process
+	assert.Nil(os.WriteFile(procsFile, []byte(self+"\n"), 0644))
+	dir, err := CgroupRoot()
+	assert.Nil(err)
+	assert.Equal(root, dir)
+	// The process is moved into the leaf cgroup
+	procs, _ := os.ReadFile(filepath.Join(mine, cgroupMain, "cgroup.procs"))
+	assert.Equal(self, string(procs))
+	ctl, _ := os.ReadFile(ctlFile)
+	assert.Equal("+pids", string(ctl))
+
+	// The changes are undone, in reverse order;
+	// a real cgroup folder has only virtual files, and can be removed
+	CgroupCleanup()
+	procs, _ = os.ReadFile(procsFile)
+	assert.Equal(self, string(procs))
+	ctl, _ = os.ReadFile(ctlFile)
+	assert.Equal("-memory", string(ctl))
+
+	// Without cgroup v2
+	assert.Nil(os.WriteFile(procMountinfo, []byte("25 1 0:22 / /sys rw - sysfs sysfs rw\n"), 0644))
+	_, err = CgroupRoot()
+	assert.NotNil(err)
+}
@@ -0,0 +1,90 @@
+// Package limits constrains the resources of the procs: the rlimits
+// are applied by the spin executable, that replaces itself with the proc,
+// and the cgroup v2 limits are applied when cgroups are available and writable.
+package limits
+
+import (
+	"errors"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The limits that kill the procs
+const (
+	ReasonTimeout = "timeout" // the run took longer than the timeout
+	ReasonMemory  = "memory"  // killed by the OOM killer of the cgroup
+)
+
+// The name of the spin command that applies the limits
+const wrapperCmd = "limit"
+
+// ErrUnsupported is returned when the limits cannot be applied on this OS
+var ErrUnsupported = errors.New("the resource limits are supported only on Linux")
+
+// The cgroup names are made from the recipe IDs
+var reCgroupName = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// Rlimits are applied to the proc, before it starts;
+// the zero values are not applied
+type Rlimits struct {
+	Files uint64 // max open files
+	Procs uint64 // max processes of the user
+}
+
+// IsEmpty returns true if no rlimit is defined
+func (rl Rlimits) IsEmpty() bool {
+	return rl.Files == 0 && rl.Procs == 0
+}
+
+// CgroupLimits are written in the cgroup of the proc;
+// the zero values mean no limit
+type CgroupLimits struct {
+	Memory int64   // bytes
+	CPU    float64 // number of CPUs
+	Procs  uint64  // max processes and threads
+}
+
+// Cgroup is the cgroup v2 of one proc, reused by the restarts
+type Cgroup struct {
+	Dir  string
+	ooms uint64 // the OOM kills seen so far
+}
+
+// Command returns the command that applies the rlimits and joins the cgroup,
+// then runs the executable with the arguments
+func Command(exe string, args []string, rl Rlimits, cgroup string) (string, []string) {
+	self, err := os.Executable()
+	if err != nil {
+		self = os.Args[0]
+	}
+	wrap := []string{wrapperCmd}
+	if rl.Files > 0 {
+		wrap = append(wrap, "--files", strconv.FormatUint(rl.Files, 10))
+	}
+	if rl.Procs > 0 {
+		wrap = append(wrap, "--procs", strconv.FormatUint(rl.Procs, 10))
+	}
+	if cgroup != "" {
+		wrap = append(wrap, "--cgroup", cgroup)
+	}
+	wrap = append(wrap, "--", exe)
+	return self, append(wrap, args...)
+}
+
+// CgroupName returns a valid cgroup name, eg: for a recipe ID and a block
+func CgroupName(parts ...string) string {
+	name := ""
+	for i, part := range parts {
+		if i > 0 {
+			name += "."
+		}
+		name += reCgroupName.ReplaceAllString(part, "_")
+	}
+	// The hidden names, and the parent folder are not allowed
+	if name = strings.TrimLeft(name, "."); name == "" {
+		return "_"
+	}
+	return name
+}
@@ -0,0 +1,50 @@
+//go:build !linux
+
+package limits
+
+import "os"
+
+// Supported is true if the limits can be applied on this OS
+const Supported = false
+
+// SetCgroupParent changes the parent cgroup; not supported
+func SetCgroupParent(dir string) {}
+
+// CgroupRoot returns an error, cgroups are not supported
+func CgroupRoot() (string, error) {
+	return "", ErrUnsupported
+}
+
+// CgroupCleanup does nothing, cgroups are not supported
+func CgroupCleanup() error {
+	return nil
+}
+
+// NewCgroup returns an error, cgroups are not supported
+func NewCgroup(name string, l CgroupLimits) (*Cgroup, error) {
+	return nil, ErrUnsupported
+}
+
+// OOMKilled returns false, cgroups are not supported
+func (cg *Cgroup) OOMKilled() bool {
+	return false
+}
+
+// Remove does nothing, cgroups are not supported
+func (cg *Cgroup) Remove() error {
+	return nil
+}
+
+// Kill kills the proc
+func Kill(pid int) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Kill()
+}
+
+// Exec returns an error, rlimits are not supported
+func Exec(rl Rlimits, cgroup string, exe string, args []string) error {
+	return ErrUnsupported
+}
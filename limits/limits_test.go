@@ -0,0 +1,29 @@
+package limits
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommand(t *testing.T) {
+	assert := assert.New(t)
+	self, _ := os.Executable()
+
+	exe, args := Command("python3", []string{"-u", "app.py"}, Rlimits{Files: 64}, "")
+	assert.Equal(self, exe)
+	assert.Equal([]string{"limit", "--files", "64", "--", "python3", "-u", "app.py"}, args)
+
+	rl := Rlimits{Procs: 5}
+	_, args = Command("bash", []string{"app.sh"}, rl, "/sys/fs/cgroup/spinal/app.sh")
+	assert.Equal([]string{"limit", "--procs", "5",
+		"--cgroup", "/sys/fs/cgroup/spinal/app.sh", "--", "bash", "app.sh"}, args)
+
+	assert.True(Rlimits{}.IsEmpty())
+	assert.False(rl.IsEmpty())
+	assert.Equal("my_app.collector.py", CgroupName("my app", "collector.py"))
+	assert.Equal("a_.._b", CgroupName("a/../b"))
+	assert.Equal("_b", CgroupName("../b"))
+	assert.Equal("_", CgroupName(".."))
+}
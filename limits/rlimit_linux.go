@@ -0,0 +1,53 @@
+package limits
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// Supported is true if the limits can be applied on this OS
+const Supported = true
+
+// Kill kills the process group of the proc
+func Kill(pid int) error {
+	return unix.Kill(-pid, unix.SIGKILL)
+}
+
+// Exec joins the cgroup and applies the rlimits to the current process,
+// then replaces it with the executable; returns only on errors
+func Exec(rl Rlimits, cgroup string, exe string, args []string) error {
+	if cgroup != "" {
+		pid := []byte(strconv.Itoa(os.Getpid()))
+		if err := os.WriteFile(filepath.Join(cgroup, "cgroup.procs"), pid, 0644); err != nil {
+			return fmt.Errorf("cannot join the cgroup: %v", err)
+		}
+	}
+	for _, lim := range []struct {
+		name     string
+		resource int
+		value    uint64
+	}{
+		{"files", unix.RLIMIT_NOFILE, rl.Files},
+		{"procs", unix.RLIMIT_NPROC, rl.Procs},
+	} {
+		if lim.value == 0 {
+			continue
+		}
+		// The hard limit can be lowered, but not raised, without privileges
+		r := &unix.Rlimit{Cur: lim.value, Max: lim.value}
+		if err := unix.Setrlimit(lim.resource, r); err != nil {
+			return fmt.Errorf("cannot limit the %s to %d: %v", lim.name, lim.value, err)
+		}
+	}
+
+	path, err := exec.LookPath(exe)
+	if err != nil {
+		return err
+	}
+	return unix.Exec(path, append([]string{exe}, args...), os.Environ())
+}
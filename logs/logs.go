@@ -0,0 +1,228 @@
+// Package logs writes the output of the procs into log files,
+// as JSON lines, with size and age based rotation.
+package logs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Log levels, compatible with Pino
+const (
+	LevelInfo  = 30
+	LevelError = 50
+)
+
+// Output streams
+const (
+	Stdout = "stdout"
+	Stderr = "stderr"
+)
+
+// Entry is one line from a log file
+type Entry struct {
+	Level  uint   `json:"level"`
+	Time   uint   `json:"time"` // Unix milliseconds
+	Msg    string `json:"msg"`
+	Pid    uint   `json:"pid,omitempty"`
+	Stream string `json:"stream,omitempty"`
+}
+
+// NewEntry creates a log entry with the current time,
+// for one line of output from a stream
+func NewEntry(stream string, pid int, msg string) Entry {
+	level := uint(LevelInfo)
+	if stream == Stderr {
+		level = LevelError
+	}
+	return Entry{
+		Level: level, Time: uint(time.Now().UnixMilli()),
+		Msg: msg, Pid: uint(pid), Stream: stream,
+	}
+}
+
+// How often the rotated files are checked for retention, while a file is open
+var pruneInterval = time.Hour
+
+// Rotation represents the rotation and retention of the log files.
+// The zero values disable the rotation.
+type Rotation struct {
+	// Rotate the file when it's larger than this, in MB
+	MaxSize int64 `yaml:"max_size,omitempty" json:"max_size,omitempty"`
+	// Rotate the file when it's older than this
+	MaxAge time.Duration `yaml:"max_age,omitempty" json:"max_age,omitempty"`
+	// How many rotated files to keep
+	MaxFiles int `yaml:"max_files,omitempty" json:"max_files,omitempty"`
+	// Delete the rotated files older than this, when the file is opened,
+	// rotated, and periodically while it's open
+	Retention time.Duration `yaml:"retention,omitempty" json:"retention,omitempty"`
+}
+
+// Writer appends log entries into one file, rotating it when needed.
+// The rotated files are named: file.log.1 (the newest), file.log.2, etc.
+type Writer struct {
+	sync.Mutex
+	path   string
+	opts   Rotation
+	file   *os.File
+	size   int64
+	opened time.Time
+	pruner *time.Timer // deletes the old rotated files, while open
+}
+
+// NewWriter creates a log writer; the file is opened on the first write
+func NewWriter(path string, opts Rotation) *Writer {
+	return &Writer{path: path, opts: opts}
+}
+
+// Path returns the path of the current log file
+func (w *Writer) Path() string {
+	return w.path
+}
+
+// Write appends one entry, as a JSON line
+func (w *Writer) Write(e Entry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	w.Lock()
+	defer w.Unlock()
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+	if w.mustRotate(int64(len(line))) {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := w.file.Write(line)
+	w.size += int64(n)
+	return err
+}
+
+// Close closes the current log file
+func (w *Writer) Close() error {
+	w.Lock()
+	defer w.Unlock()
+	if w.pruner != nil {
+		w.pruner.Stop()
+		w.pruner = nil
+	}
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+func (w *Writer) open() error {
+	if err := os.MkdirAll(filepath.Dir(w.path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file = f
+	w.size = info.Size()
+	w.opened = time.Now()
+	if w.size > 0 {
+		// The creation time is not portable, the last change is close enough
+		w.opened = info.ModTime()
+	}
+
+	if w.opts.Retention > 0 {
+		w.prune()
+		if w.pruner == nil {
+			w.pruner = time.AfterFunc(pruneInterval, w.prunePeriodically)
+		}
+	}
+	return nil
+}
+
+func (w *Writer) mustRotate(next int64) bool {
+	if w.size == 0 {
+		return false
+	}
+	if w.opts.MaxSize > 0 && w.size+next > w.opts.MaxSize*1024*1024 {
+		return true
+	}
+	return w.opts.MaxAge > 0 && time.Since(w.opened) > w.opts.MaxAge
+}
+
+// rotate renames the current file and the older files,
+// deletes the files over the limit, and opens a new file
+func (w *Writer) rotate() error {
+	w.file.Close()
+	w.file = nil
+
+	maxFiles := w.opts.MaxFiles
+	if maxFiles < 1 {
+		maxFiles = 1
+	}
+	// Find the last rotated file
+	last := 1
+	for fileExists(w.rotated(last)) {
+		last++
+	}
+	for i := last - 1; i >= 1; i-- {
+		if i >= maxFiles {
+			os.Remove(w.rotated(i))
+			continue
+		}
+		os.Rename(w.rotated(i), w.rotated(i+1))
+	}
+	if err := os.Rename(w.path, w.rotated(1)); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+// prune deletes the rotated files older than the retention
+func (w *Writer) prune() {
+	maxFiles := w.opts.MaxFiles
+	if maxFiles < 1 {
+		maxFiles = 1
+	}
+	for i := 1; i <= maxFiles; i++ {
+		info, err := os.Stat(w.rotated(i))
+		if err == nil && time.Since(info.ModTime()) > w.opts.Retention {
+			os.Remove(w.rotated(i))
+		}
+	}
+}
+
+// prunePeriodically runs from the timer, until the writer is closed
+func (w *Writer) prunePeriodically() {
+	w.Lock()
+	defer w.Unlock()
+	if w.pruner == nil {
+		return
+	}
+	w.prune()
+	w.pruner.Reset(pruneInterval)
+}
+
+func (w *Writer) rotated(i int) string {
+	return fmt.Sprintf("%s.%d", w.path, i)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,208 @@
+package logs
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readEntries(t *testing.T, path string) []Entry {
+	f, err := os.Open(path)
+	assert.Nil(t, err)
+	defer f.Close()
+	entries := []Entry{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		e := Entry{}
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &e))
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestWriteEntries(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "logs", "x.log")
+
+	w := NewWriter(path, Rotation{})
+	assert.Nil(w.Write(NewEntry(Stdout, 123, "hello")))
+	assert.Nil(w.Write(NewEntry(Stderr, 123, "oops")))
+	assert.Nil(w.Close())
+
+	entries := readEntries(t, path)
+	assert.Equal(2, len(entries))
+	assert.Equal(Entry{Level: LevelInfo, Time: entries[0].Time, Msg: "hello", Pid: 123, Stream: Stdout}, entries[0])
+	assert.Equal(uint(LevelError), entries[1].Level)
+	assert.Equal(Stderr, entries[1].Stream)
+	assert.True(entries[0].Time > 0)
+}
+
+func TestRotateSize(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "x.log")
+
+	w := NewWriter(path, Rotation{MaxSize: 1, MaxFiles: 2})
+	line := strings.Repeat("x", 300*1024)
+	for i := 0; i < 10; i++ {
+		assert.Nil(w.Write(NewEntry(Stdout, 1, line)))
+	}
+	assert.Nil(w.Close())
+
+	// 3 entries per file; 10 entries = 4 files, only 2 rotated are kept
+	assert.Equal(1, len(readEntries(t, path)))
+	assert.Equal(3, len(readEntries(t, path+".1")))
+	assert.Equal(3, len(readEntries(t, path+".2")))
+	assert.False(fileExists(path + ".3"))
+}
+
+func TestRotateAge(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "x.log")
+
+	w := NewWriter(path, Rotation{MaxAge: 100 * time.Millisecond, MaxFiles: 5})
+	assert.Nil(w.Write(NewEntry(Stdout, 1, "a")))
+	assert.Nil(w.Write(NewEntry(Stdout, 1, "b")))
+	time.Sleep(150 * time.Millisecond)
+	assert.Nil(w.Write(NewEntry(Stdout, 1, "c")))
+	assert.Nil(w.Close())
+
+	assert.Equal(2, len(readEntries(t, path+".1")))
+	assert.Equal("c", readEntries(t, path)[0].Msg)
+}
+
+func TestRetention(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "x.log")
+	old := time.Now().Add(-time.Hour)
+	assert.Nil(os.WriteFile(path+".1", []byte("{}\n"), 0644))
+	assert.Nil(os.Chtimes(path+".1", old, old))
+
+	w := NewWriter(path, Rotation{MaxSize: 1, MaxFiles: 5, Retention: time.Minute})
+	line := strings.Repeat("x", 600*1024)
+	assert.Nil(w.Write(NewEntry(Stdout, 1, line)))
+	assert.Nil(w.Write(NewEntry(Stdout, 1, line)))
+	assert.Nil(w.Close())
+
+	// The old file was deleted on open, before the rotation
+	assert.True(fileExists(path + ".1"))
+	assert.False(fileExists(path + ".2"))
+
+	// Without rotation, the old files are deleted on open, and periodically
+	pruneInterval = 50 * time.Millisecond
+	defer func() { pruneInterval = time.Hour }()
+	assert.Nil(os.Chtimes(path+".1", old, old))
+	w = NewWriter(path, Rotation{MaxFiles: 5, Retention: time.Minute})
+	assert.Nil(w.Write(NewEntry(Stdout, 1, "a")))
+	assert.False(fileExists(path + ".1"))
+	assert.Nil(os.WriteFile(path+".2", []byte("{}\n"), 0644))
+	assert.Nil(os.Chtimes(path+".2", old, old))
+	time.Sleep(3 * pruneInterval)
+	assert.False(fileExists(path + ".2"))
+	assert.Nil(w.Close())
+}
+
+func TestFilterLines(t *testing.T) {
+	assert := assert.New(t)
+	lvl, err := ParseLevel("warn")
+	assert.Nil(err)
+	assert.Equal(uint(40), lvl)
+	lvl, _ = ParseLevel("50")
+	assert.Equal(uint(50), lvl)
+	_, err = ParseLevel("loud")
+	assert.NotNil(err)
+	assert.Equal("error", LevelName(50))
+
+	now := time.Now()
+	since, _ := ParseSince("1m", now)
+	assert.Equal(uint(now.Add(-time.Minute).UnixMilli()), since)
+	since, _ = ParseSince("1500", now)
+	assert.Equal(uint(1500), since)
+	_, err = ParseSince("yesterday", now)
+	assert.NotNil(err)
+
+	f := Filter{Level: LevelError, Since: 1000}
+	assert.True(f.Match([]byte(`{"level":50,"time":2000,"msg":"x"}`)))
+	assert.False(f.Match([]byte(`{"level":30,"time":2000,"msg":"x"}`)))
+	assert.False(f.Match([]byte(`{"level":50,"time":500,"msg":"x"}`)))
+	assert.False(f.Match([]byte("plain text")))
+	assert.True(Filter{}.Match([]byte("plain text")))
+}
+
+func TestReadLast(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "x.log")
+	lines, offset, err := ReadLast(path, 2, Filter{})
+	assert.Nil(err)
+	assert.Equal(0, len(lines))
+	assert.Equal(int64(0), offset)
+
+	text := `{"level":30,"msg":"a"}` + "\n" + `{"level":50,"msg":"b"}` + "\n" +
+		`{"level":30,"msg":"c"}` + "\n" + `{"level":50,"msg":"d"}` + "\n" + `{"level":30`
+	assert.Nil(os.WriteFile(path, []byte(text), 0644))
+
+	lines, offset, err = ReadLast(path, 2, Filter{})
+	assert.Nil(err)
+	assert.Equal([][]byte{[]byte(`{"level":30,"msg":"c"}`), []byte(`{"level":50,"msg":"d"}`)}, lines)
+	// The incomplete line is not read
+	assert.Equal(int64(strings.LastIndex(text, "\n")+1), offset)
+
+	lines, _, _ = ReadLast(path, 0, Filter{Level: LevelError})
+	assert.Equal(2, len(lines))
+
+	// The lines span several chunks, when reading backward
+	defer func(size int64) { readChunk = size }(readChunk)
+	readChunk = 7
+	lines, offset, err = ReadLast(path, 3, Filter{Level: LevelError})
+	assert.Nil(err)
+	assert.Equal([][]byte{[]byte(`{"level":50,"msg":"b"}`), []byte(`{"level":50,"msg":"d"}`)}, lines)
+	assert.Equal(int64(strings.LastIndex(text, "\n")+1), offset)
+	lines, _, _ = ReadLast(path, 10, Filter{})
+	assert.Equal(4, len(lines))
+	assert.Equal(`{"level":30,"msg":"a"}`, string(lines[0]))
+}
+
+func TestFollow(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "x.log")
+	interval := 10 * time.Millisecond
+
+	lines := make(chan string, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go Follow(ctx, path, 0, interval, func(line []byte) {
+		lines <- string(line)
+	})
+	next := func() string {
+		select {
+		case line := <-lines:
+			return line
+		case <-time.After(time.Second):
+			return "timeout"
+		}
+	}
+
+	// The file is created later
+	w := NewWriter(path, Rotation{MaxSize: 1, MaxFiles: 1})
+	assert.Nil(w.Write(Entry{Msg: "a"}))
+	assert.Contains(next(), `"msg":"a"`)
+
+	// Rotation
+	assert.Nil(w.Write(Entry{Msg: strings.Repeat("x", 1024*1024)}))
+	assert.Contains(next(), `"msg":"xxx`)
+	assert.Nil(w.Write(Entry{Msg: "b"}))
+	assert.Contains(next(), `"msg":"b"`)
+	assert.Nil(w.Close())
+
+	// Truncation
+	time.Sleep(3 * interval)
+	assert.Nil(os.WriteFile(path, []byte("c\n"), 0644))
+	assert.Equal("c", next())
+}
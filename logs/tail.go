@@ -0,0 +1,277 @@
+package logs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Pino level names
+var levelNames = map[string]uint{
+	"trace": 10, "debug": 20, "info": 30, "warn": 40, "error": 50, "fatal": 60,
+}
+
+// ParseLevel converts a level name, or number, into a number
+func ParseLevel(text string) (uint, error) {
+	if lvl, ok := levelNames[strings.ToLower(text)]; ok {
+		return lvl, nil
+	}
+	lvl, err := strconv.ParseUint(text, 10, 16)
+	if err != nil {
+		return 0, errors.New("invalid level: " + text)
+	}
+	return uint(lvl), nil
+}
+
+// LevelName returns the name of a level number, or the number
+func LevelName(level uint) string {
+	for name, lvl := range levelNames {
+		if lvl == level {
+			return name
+		}
+	}
+	return strconv.FormatUint(uint64(level), 10)
+}
+
+// ParseSince converts a time into Unix milliseconds.
+// The time can be in milliseconds, in RFC3339 format,
+// or a duration before now, eg: "10m".
+func ParseSince(text string, now time.Time) (uint, error) {
+	if ms, err := strconv.ParseUint(text, 10, 64); err == nil {
+		return uint(ms), nil
+	}
+	if t, err := time.Parse(time.RFC3339, text); err == nil {
+		return uint(t.UnixMilli()), nil
+	}
+	if d, err := time.ParseDuration(text); err == nil && d >= 0 {
+		return uint(now.Add(-d).UnixMilli()), nil
+	}
+	return 0, errors.New("invalid time: " + text)
+}
+
+// ParseLine converts a log line into an entry;
+// the lines that are not JSON become messages.
+func ParseLine(line []byte) (Entry, bool) {
+	e := Entry{}
+	if err := json.Unmarshal(line, &e); err != nil {
+		return Entry{Msg: string(line)}, false
+	}
+	return e, true
+}
+
+// Filter selects the log lines with a minimum level,
+// written after a time (Unix milliseconds).
+// The lines that are not JSON are selected only without a filter.
+type Filter struct {
+	Level uint
+	Since uint
+}
+
+// Match returns true if the line is selected
+func (f Filter) Match(line []byte) bool {
+	e, ok := ParseLine(line)
+	if !ok {
+		return f.Level == 0 && f.Since == 0
+	}
+	return e.Level >= f.Level && e.Time >= f.Since
+}
+
+// The size of the chunks read backward from the end of the files
+var readChunk int64 = 64 * 1024
+
+// ReadLast returns the last N lines of a file that match the filter,
+// or all of them when N is 0, and the offset where the lines end.
+// For N lines, the file is read backward from the end, in chunks.
+// A missing file has no lines.
+func ReadLast(path string, n int, f Filter) ([][]byte, int64, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+	if n <= 0 {
+		return readAll(file, f)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	// The lines are collected from the end, in reverse order
+	lines := [][]byte{}
+	add := func(line []byte) {
+		line = bytes.TrimRight(line, "\r")
+		if len(line) > 0 && f.Match(line) {
+			lines = append(lines, append([]byte{}, line...))
+		}
+	}
+
+	var (
+		pos  = info.Size()
+		end  = int64(-1) // the offset after the last complete line
+		rest []byte      // the bytes from pos, not split in lines yet
+	)
+	buf := make([]byte, readChunk)
+	for pos > 0 && len(lines) < n {
+		size := readChunk
+		if size > pos {
+			size = pos
+		}
+		pos -= size
+		if _, err := file.ReadAt(buf[:size], pos); err != nil && err != io.EOF {
+			return nil, 0, err
+		}
+		rest = append(append([]byte{}, buf[:size]...), rest...)
+		if end < 0 {
+			// An incomplete line is read later, when it's complete
+			i := bytes.LastIndexByte(rest, '\n')
+			if i < 0 {
+				continue
+			}
+			end = pos + int64(i) + 1
+			rest = rest[:i]
+		}
+		for len(lines) < n {
+			i := bytes.LastIndexByte(rest, '\n')
+			if i < 0 {
+				// The first line of the file is complete
+				if pos == 0 {
+					add(rest)
+					rest = nil
+				}
+				break
+			}
+			add(rest[i+1:])
+			rest = rest[:i]
+		}
+	}
+	if end < 0 {
+		end = 0
+	}
+
+	for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+		lines[i], lines[j] = lines[j], lines[i]
+	}
+	return lines, end, nil
+}
+
+// readAll returns all the lines of a file that match the filter,
+// and the offset where the lines end
+func readAll(file *os.File, f Filter) ([][]byte, int64, error) {
+	lines := [][]byte{}
+	var offset int64
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// An incomplete line is read later, when it's complete
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += int64(len(line))
+		line = bytes.TrimRight(line, "\r\n")
+		if len(line) == 0 || !f.Match(line) {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, offset, nil
+}
+
+// Follow reads the new lines of a file, from the offset,
+// checking for changes at every interval, until the context is done.
+// When the file is rotated, the rest of the old file is read,
+// then the new file is read from the start.
+// When the file is truncated, it's read from the start.
+func Follow(ctx context.Context, path string, offset int64, interval time.Duration, fn func([]byte)) {
+	var (
+		file    *os.File
+		info    os.FileInfo
+		partial []byte
+	)
+	defer func() {
+		if file != nil {
+			file.Close()
+		}
+	}()
+
+	buf := make([]byte, 32*1024)
+	readNew := func() {
+		for {
+			n, err := file.Read(buf)
+			if n > 0 {
+				offset += int64(n)
+				partial = append(partial, buf[:n]...)
+				for {
+					i := bytes.IndexByte(partial, '\n')
+					if i < 0 {
+						break
+					}
+					line := bytes.TrimRight(partial[:i], "\r")
+					if len(line) > 0 {
+						fn(line)
+					}
+					partial = partial[i+1:]
+				}
+			}
+			if err != nil || n == 0 {
+				return
+			}
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if file == nil {
+			if f, err := os.Open(path); err == nil {
+				if stat, err := f.Stat(); err != nil {
+					// Rotated, or deleted meanwhile; retry on the next tick
+					f.Close()
+				} else {
+					info = stat
+					if info.Size() < offset {
+						offset = 0
+					}
+					f.Seek(offset, io.SeekStart)
+					file = f
+				}
+			}
+		}
+		if file != nil {
+			// Check before reading, so the old file is read until the end
+			current, err := os.Stat(path)
+			readNew()
+			if err != nil || !os.SameFile(info, current) {
+				// Rotated, or deleted
+				file.Close()
+				file = nil
+				offset = 0
+				partial = nil
+			} else if current.Size() < offset {
+				// Truncated
+				file.Seek(0, io.SeekStart)
+				offset = 0
+				partial = nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
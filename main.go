@@ -1,16 +1,28 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	ml "github.com/ShinyTrinkets/meta-logger"
 	do "github.com/ShinyTrinkets/spinal/command"
+	config "github.com/ShinyTrinkets/spinal/config"
+	"github.com/ShinyTrinkets/spinal/limits"
+	"github.com/ShinyTrinkets/spinal/logs"
 	parse "github.com/ShinyTrinkets/spinal/parser"
+	"github.com/ShinyTrinkets/spinal/schedule"
+	"github.com/ShinyTrinkets/spinal/secrets"
+	"github.com/ShinyTrinkets/spinal/state"
 	log "github.com/azer/logger"
 	cli "github.com/jawher/mow.cli"
 )
@@ -46,6 +58,10 @@ func main() {
 	app.Command("list", "List all candidate source-files from folder", cmdList)
 	app.Command("status", "Show the status of a running Spinal instance", cmdClient)
 	app.Command("up", "Convert all source-files from folder and execute them", cmdSpinUp)
+	app.Command("state", "Show the state saved by the last Spinal run", cmdState)
+	app.Command("logs", "Show the logs of a spin, from a running Spinal instance", cmdLogs)
+	app.Command("secret", "Manage the encrypted secrets, injected into the spins", cmdSecret)
+	app.Command("limit", "Apply the resource limits and run a command (used internally)", cmdLimit)
 
 	app.Run(os.Args)
 }
@@ -55,6 +71,8 @@ func cmdList(cmd *cli.Cmd) {
 	dir := cmd.StringArg("FOLDER", "", "the folder to list")
 
 	cmd.Action = func() {
+		// The config can define extra languages
+		config.LoadConfig("config.yaml")
 		files, err := parse.ParseFolder(*dir, false)
 		if err != nil {
 			fmt.Printf("List failed. Error: %v\n", err)
@@ -72,11 +90,21 @@ func cmdList(cmd *cli.Cmd) {
 			if !parsed.Enabled {
 				enabled = "■"
 			}
-			var langs []string
-			for lng := range parsed.Blocks {
-				langs = append(langs, lng)
+			var blocks []string
+			for key := range parsed.Blocks {
+				blocks = append(blocks, key)
 			}
-			fmt.Printf("%s %s ▻ %v\n", enabled, parsed.Path, langs)
+			sort.Strings(blocks)
+			fmt.Printf("%s %s ▻ %v", enabled, parsed.Path, blocks)
+			if parsed.Schedule != "" {
+				sch, err := schedule.Parse(parsed.Schedule)
+				if err != nil {
+					fmt.Printf(" ⏲ %v", err)
+				} else if next := sch.Next(time.Now()); !next.IsZero() {
+					fmt.Printf(" ⏲ next: %s", next.Format(time.RFC3339))
+				}
+			}
+			fmt.Println()
 		}
 	}
 }
@@ -106,15 +134,221 @@ func cmdClient(cmd *cli.Cmd) {
 	}
 }
 
+func cmdState(cmd *cli.Cmd) {
+	cmd.Spec = "[--file] [--json]"
+	fname := cmd.StringOpt("file", "", "the state file, instead of the one from config")
+	asJSON := cmd.BoolOpt("json", false, "print the raw state, as JSON")
+
+	cmd.Action = func() {
+		if *fname == "" {
+			cfg := config.LoadConfig("config.yaml")
+			*fname = cfg.StatePath()
+		}
+		if *fname == "" {
+			fmt.Println("The state file is not enabled! Set state_file in the config.")
+			return
+		}
+		tree, err := state.Load(*fname)
+		if err != nil {
+			fmt.Printf("Cannot load the state file! Error: %v\n", err)
+			return
+		}
+		if *asJSON {
+			out, _ := json.MarshalIndent(tree, "", "  ")
+			fmt.Println(string(out))
+			return
+		}
+
+		for _, r := range tree.Recipes {
+			fmt.Printf("%s (%s) ▻ %s, restarts: %d\n", r.Path, r.ID, r.Kind, r.Restarts)
+			if r.Schedule != nil {
+				fmt.Printf("  ⏲ %s, runs: %d, skipped: %d", r.Schedule.Expr, r.Schedule.Runs, r.Schedule.Skipped)
+				if !r.Schedule.LastRun.IsZero() {
+					fmt.Printf(", last run: %s", r.Schedule.LastRun.Format(time.RFC3339))
+				}
+				fmt.Println()
+			}
+			if r.Health != nil && r.Health.LastFailure != "" {
+				fmt.Printf("  ♥ %s, last failure: %s (%s)\n", r.Health.Status,
+					r.Health.LastFailure, r.Health.LastFailureAt.Format(time.RFC3339))
+			}
+			for key, err := range r.Errors {
+				fmt.Printf("  ✗ %s: %s\n", key, err)
+			}
+			for _, p := range r.Procs {
+				fmt.Printf("  - %s: %s", p.ID, p.State)
+				if p.Result != "" {
+					fmt.Printf(", %s", p.Result)
+				}
+				if p.LastExit != nil {
+					fmt.Printf(", exit code %d at %s", p.LastExit.Code, p.LastExit.Time.Format(time.RFC3339))
+					if p.LastExit.Error != "" {
+						fmt.Printf(" (%s)", p.LastExit.Error)
+					}
+				}
+				fmt.Println()
+			}
+		}
+	}
+}
+
+func cmdSecret(cmd *cli.Cmd) {
+	// openSecrets loads the secrets store from the config
+	openSecrets := func() *secrets.Store {
+		cfg := config.LoadConfig("config.yaml")
+		store, err := secrets.Open(cfg.SecretsPath(), cfg.SecretsKeyFile)
+		if err != nil {
+			fmt.Printf("Cannot open the secrets! Error: %v\n", err)
+			cli.Exit(1)
+		}
+		return store
+	}
+	saveSecrets := func(store *secrets.Store) {
+		if err := store.Save(); err != nil {
+			fmt.Printf("Cannot save the secrets! Error: %v\n", err)
+			cli.Exit(1)
+		}
+	}
+
+	cmd.Command("set", "Add, or replace a secret; the value is read from stdin if missing", func(cmd *cli.Cmd) {
+		cmd.Spec = "NAME [VALUE]"
+		name := cmd.StringArg("NAME", "", "the secret name, eg: DB_PASS")
+		value := cmd.StringArg("VALUE", "", "the secret value")
+		cmd.Action = func() {
+			if *value == "" {
+				data, err := ioutil.ReadAll(os.Stdin)
+				if err != nil {
+					fmt.Printf("Cannot read the value! Error: %v\n", err)
+					cli.Exit(1)
+				}
+				*value = strings.TrimRight(string(data), "\r\n")
+			}
+			store := openSecrets()
+			if err := store.Set(*name, *value); err != nil {
+				fmt.Printf("Cannot set the secret! Error: %v\n", err)
+				cli.Exit(1)
+			}
+			saveSecrets(store)
+		}
+	})
+
+	cmd.Command("get", "Print the value of a secret", func(cmd *cli.Cmd) {
+		cmd.Spec = "NAME"
+		name := cmd.StringArg("NAME", "", "the secret name")
+		cmd.Action = func() {
+			value, ok := openSecrets().Get(*name)
+			if !ok {
+				fmt.Printf("Secret '%s' doesn't exist!\n", *name)
+				cli.Exit(1)
+			}
+			fmt.Println(value)
+		}
+	})
+
+	cmd.Command("list ls", "List the names of the secrets", func(cmd *cli.Cmd) {
+		cmd.Action = func() {
+			for _, name := range openSecrets().Names() {
+				fmt.Println(name)
+			}
+		}
+	})
+
+	cmd.Command("rm", "Remove a secret", func(cmd *cli.Cmd) {
+		cmd.Spec = "NAME"
+		name := cmd.StringArg("NAME", "", "the secret name")
+		cmd.Action = func() {
+			store := openSecrets()
+			if !store.Remove(*name) {
+				fmt.Printf("Secret '%s' doesn't exist!\n", *name)
+				cli.Exit(1)
+			}
+			saveSecrets(store)
+		}
+	})
+}
+
+func cmdLogs(cmd *cli.Cmd) {
+	cmd.Spec = "[-c] [-f] [-n] [--level] [--since] ID"
+	httpOpts := cmd.StringOpt("c http", "localhost:12323", "HTTP server host:port")
+	follow := cmd.BoolOpt("f follow", false, "keep streaming the new lines")
+	lines := cmd.IntOpt("n lines", 10, "how many lines to show from the end")
+	level := cmd.StringOpt("level", "", "the minimum level, eg: warn, or 40")
+	since := cmd.StringOpt("since", "", "show the lines after a time, eg: 10m, or RFC3339")
+	id := cmd.StringArg("ID", "", "the log ID, eg: the recipe ID")
+
+	cmd.Action = func() {
+		query := url.Values{}
+		query.Set("lines", strconv.Itoa(*lines))
+		if !*follow {
+			query.Set("follow", "false")
+		}
+		if *level != "" {
+			query.Set("level", *level)
+		}
+		if *since != "" {
+			query.Set("since", *since)
+		}
+		resp, err := http.Get("http://" + *httpOpts + "/log/" + url.PathEscape(*id) + "/stream?" + query.Encode())
+		if err != nil {
+			fmt.Printf("Failed Spinal connection. Error: %v\n", err)
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			body, _ := ioutil.ReadAll(resp.Body)
+			fmt.Printf("Failed Spinal reponse. Error: %s\n", body)
+			return
+		}
+
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(nil, 1024*1024)
+		for scanner.Scan() {
+			data := strings.TrimPrefix(scanner.Text(), "data: ")
+			if data == scanner.Text() {
+				// Empty lines and comments
+				continue
+			}
+			e, _ := logs.ParseLine([]byte(data))
+			if e.Time > 0 {
+				fmt.Print(time.UnixMilli(int64(e.Time)).Format("15:04:05.000 "))
+			}
+			if e.Level > 0 {
+				fmt.Print(logs.LevelName(e.Level) + " ")
+			}
+			if e.Stream != "" {
+				fmt.Print("[" + e.Stream + "] ")
+			}
+			fmt.Println(e.Msg)
+		}
+	}
+}
+
 func cmdSpinUp(cmd *cli.Cmd) {
-	cmd.Spec = "FILES [-f] [-n|--http] [--dry-run]"
+	cmd.Spec = "FILES [-f] [-n|--http] [--dry-run] [-w]"
 	rootDir := cmd.StringArg("FILES", "", "the file or folder to convert and run")
 	force := cmd.BoolOpt("f force", false, "force conversion by ignoring the header")
 	noHTTP := cmd.BoolOpt("n no-http", false, "don't start the HTTP server")
 	httpOpts := cmd.StringOpt("http", "localhost:12323", "HTTP server host:port")
 	dryRun := cmd.BoolOpt("dry-run", false, "convert the sources and simulate running")
+	watch := cmd.BoolOpt("w watch", false, "reload the sources when they change")
+
+	cmd.Action = func() {
+		do.SpinUp(*rootDir, *force, *httpOpts, *noHTTP, *dryRun, *watch)
+	}
+}
+
+func cmdLimit(cmd *cli.Cmd) {
+	cmd.Spec = "[--files] [--procs] [--cgroup] -- EXE [ARGS...]"
+	files := cmd.IntOpt("files", 0, "max open files")
+	procs := cmd.IntOpt("procs", 0, "max processes of the user")
+	cgroup := cmd.StringOpt("cgroup", "", "the cgroup v2 folder to join")
+	exe := cmd.StringArg("EXE", "", "the command to run")
+	args := cmd.StringsArg("ARGS", nil, "the command arguments")
 
 	cmd.Action = func() {
-		do.SpinUp(*rootDir, *force, *httpOpts, *noHTTP, *dryRun)
+		rl := limits.Rlimits{Files: uint64(*files), Procs: uint64(*procs)}
+		err := limits.Exec(rl, *cgroup, *exe, *args)
+		fmt.Fprintf(os.Stderr, "Cannot run '%s'! Error: %v\n", *exe, err)
+		cli.Exit(1)
 	}
 }
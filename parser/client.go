@@ -0,0 +1,209 @@
+// File client.go contains the Spinal clients, injected in the generated code.
+// The clients don't have dependencies; they talk to the HTTP server
+// from the SPIN_API environment variable, and log into the SPIN_LOG file.
+package parser
+
+// The Javascript client, shared by CommonJS and ES Modules;
+// the http module is the argument of the function
+const jsClient = `((http) => {
+  const api = process.env.SPIN_API || ''
+  const enc = encodeURIComponent
+  // Calls the Spinal API; resolves to the JSON response, or undefined for 404
+  const call = (method, path, body) => new Promise((resolve, reject) => {
+    if (!api) return reject(new Error('SPIN_API is not set; is the HTTP server enabled?'))
+    const req = http.request(api + path, { method }, (res) => {
+      let data = ''
+      res.setEncoding('utf8')
+      res.on('data', (chunk) => { data += chunk })
+      res.on('end', () => {
+        if (res.statusCode === 404) return resolve(undefined)
+        if (res.statusCode >= 300) return reject(new Error(method + ' ' + path + ': ' + res.statusCode + ' ' + data))
+        try { resolve(JSON.parse(data)) } catch (err) { resolve(data) }
+      })
+    })
+    req.on('error', reject)
+    if (body !== undefined) req.write(JSON.stringify(body))
+    req.end()
+  })
+  const kvPath = (store, key) => '/kv/' + enc(store) + '/' + enc(key)
+  spinal.api = api
+  spinal.kv = {
+    get: (store, key) => call('GET', kvPath(store, key)),
+    set: (store, key, value, ttl) => call('POST', kvPath(store, key) + (ttl ? '?ttl=' + enc(ttl) : ''), value),
+    delete: (store, key) => call('DELETE', kvPath(store, key)),
+    keys: (store, prefix) => call('GET', '/kv/' + enc(store) + '?prefix=' + enc(prefix || ''))
+      .then((page) => (page ? page.keys : [])),
+  }
+  // The log lines are sent to the API, or printed if it's not available;
+  // the output of the procs is captured in the logs: stdout as info, stderr as error
+  const logName = process.env.SPIN_LOG || process.env.SPIN_ID || ''
+  const log = (lvl, print, args) => {
+    if (!api || !logName) return Promise.resolve(print(...args))
+    const msg = args.map((a) => (typeof a === 'string' ? a : JSON.stringify(a))).join(' ')
+    const query = '?lvl=' + lvl + '&pid=' + process.pid + '&msg=' + enc(msg)
+    return call('POST', '/log/' + enc(logName) + query).then(() => undefined, () => print(...args))
+  }
+  spinal.log = {
+    info: (...args) => log(30, console.log, args),
+    error: (...args) => log(50, console.error, args),
+  }
+  // The whole state, or the state of one recipe, by path
+  spinal.state = (path) => call('GET', path ? '/state/' + enc(path) : '/state')
+})`
+
+// The Python client; the spinal dict gets the kv, log and state attributes
+const pyClient = `import json as _json
+import os as _os
+import sys as _sys
+from urllib import error as _error, parse as _parse, request as _request
+
+
+def _spinal_call(method, path, body=None):
+    """Calls the Spinal API; returns the JSON response, or None for 404"""
+    api = _os.environ.get('SPIN_API', '')
+    if not api:
+        raise RuntimeError('SPIN_API is not set; is the HTTP server enabled?')
+    data = None if body is None else _json.dumps(body).encode()
+    req = _request.Request(api + path, data=data, method=method)
+    try:
+        with _request.urlopen(req) as resp:
+            text = resp.read().decode()
+    except _error.HTTPError as err:
+        if err.code == 404:
+            return None
+        raise
+    try:
+        return _json.loads(text)
+    except ValueError:
+        return text
+
+
+def _kv_path(store, key):
+    return '/kv/' + _parse.quote(store, safe='') + '/' + _parse.quote(key, safe='')
+
+
+class _SpinalKV:
+    def get(self, store, key):
+        return _spinal_call('GET', _kv_path(store, key))
+
+    def set(self, store, key, value, ttl=None):
+        query = '?ttl=' + _parse.quote(str(ttl)) if ttl else ''
+        return _spinal_call('POST', _kv_path(store, key) + query, value)
+
+    def delete(self, store, key):
+        return _spinal_call('DELETE', _kv_path(store, key))
+
+    def keys(self, store, prefix=''):
+        page = _spinal_call('GET', '/kv/' + _parse.quote(store, safe='') + '?prefix=' + _parse.quote(prefix))
+        return page['keys'] if page else []
+
+
+class _SpinalLog:
+    """The log lines are sent to the API, or printed if it's not available;
+    the output of the procs is captured in the logs: stdout as info, stderr as error"""
+
+    def _send(self, lvl, args):
+        name = _os.environ.get('SPIN_LOG') or _os.environ.get('SPIN_ID', '')
+        if not _os.environ.get('SPIN_API') or not name:
+            return False
+        msg = ' '.join(str(arg) for arg in args)
+        query = _parse.urlencode({'lvl': lvl, 'pid': _os.getpid(), 'msg': msg})
+        try:
+            _spinal_call('POST', '/log/' + _parse.quote(name, safe='') + '?' + query)
+            return True
+        except Exception:
+            return False
+
+    def info(self, *args):
+        if not self._send(30, args):
+            print(*args, flush=True)
+
+    def error(self, *args):
+        if not self._send(50, args):
+            print(*args, file=_sys.stderr, flush=True)
+
+
+class _Spinal(dict):
+    api = _os.environ.get('SPIN_API', '')
+    kv = _SpinalKV()
+    log = _SpinalLog()
+
+    def state(self, path=None):
+        """The whole state, or the state of one recipe, by path"""
+        return _spinal_call('GET', '/state/' + _parse.quote(path, safe='') if path else '/state')
+
+
+spinal = _Spinal(spinal)`
+
+// The shell client, for Bash and ZSH; the API is called with curl.
+// The values are JSON, eg: spinal_kv_set store key '"text"' 10s
+const shClient = `spinal_urlencode() {
+  local LC_ALL=C s="$1" out="" c i
+  for (( i = 0; i < ${#s}; i++ )); do
+    c="${s:$i:1}"
+    case "$c" in
+      [a-zA-Z0-9.~_-]) out+="$c" ;;
+      *) out+=$(printf '%%%02X' "'$c") ;;
+    esac
+  done
+  printf '%s' "$out"
+}
+# Calls the Spinal API: method path [curl args]; fails silently for 404 and errors
+spinal_call() {
+  if [ -z "$SPIN_API" ]; then
+    echo "SPIN_API is not set; is the HTTP server enabled?" >&2
+    return 1
+  fi
+  local method="$1" path="$2"
+  shift 2
+  curl -sf -X "$method" "$@" "$SPIN_API$path"
+}
+spinal_kv_get() {
+  spinal_call GET "/kv/$(spinal_urlencode "$1")/$(spinal_urlencode "$2")"
+}
+spinal_kv_set() {
+  spinal_call POST "/kv/$(spinal_urlencode "$1")/$(spinal_urlencode "$2")?ttl=$(spinal_urlencode "$4")" --data-binary "$3" >/dev/null
+}
+spinal_kv_del() {
+  spinal_call DELETE "/kv/$(spinal_urlencode "$1")/$(spinal_urlencode "$2")" >/dev/null
+}
+spinal_kv_keys() {
+  spinal_call GET "/kv/$(spinal_urlencode "$1")?prefix=$(spinal_urlencode "$2")"
+}
+# The whole state, or the state of one recipe, by path
+spinal_state() {
+  if [ -n "$1" ]; then
+    spinal_call GET "/state/$(spinal_urlencode "$1")"
+  else
+    spinal_call GET /state
+  fi
+}
+# The log lines are sent to the API, or printed if it's not available;
+# the output of the procs is captured in the logs: stdout as info, stderr as error
+spinal_log() {
+  local lvl="$1" name="${SPIN_LOG:-$SPIN_ID}"
+  shift
+  [ -n "$SPIN_API" ] && [ -n "$name" ] &&
+    spinal_call POST "/log/$(spinal_urlencode "$name")?lvl=$lvl&pid=$$&msg=$(spinal_urlencode "$*")" >/dev/null
+}
+spinal_log_info() {
+  spinal_log 30 "$@" || echo "$@"
+}
+spinal_log_error() {
+  spinal_log 50 "$@" || echo "$@" >&2
+}`
+
+// clientCode returns the Spinal client for the language,
+// or empty if the language doesn't have a client
+func clientCode(lang string) (str string) {
+	if lang == "js" {
+		str = ";" + jsClient + "(require('http'));"
+	} else if lang == "mjs" {
+		str = "import spinalHttp from 'http';\n" + jsClient + "(spinalHttp);"
+	} else if lang == "py" {
+		str = pyClient
+	} else if lang == "sh" || lang == "zsh" {
+		str = shClient
+	}
+	return
+}
@@ -5,53 +5,78 @@ package parser
 
 import (
 	"encoding/json"
+	"fmt"
 	"regexp"
+	"sort"
 	"strings"
 	"text/template"
 )
 
-// ParseBlocks extracts all code blocks from text
-// The result will be in the form: {language => content}
-func ParseBlocks(body string) map[string]string {
+// ParseBlocks extracts all code blocks from text, for all known languages
+// The result will be in the form: {block key => block}
+// Blocks of the same language are joined together, unless they are named,
+// eg: ```py name=collector ; named blocks are joined only with the blocks
+// of the same language and name.
+func ParseBlocks(body string) map[string]CodeBlock {
 	// TODO: needs extra processing steps,
 	// eg: for Javascript, might want to use Babel + Prettify
 
-	langsList := []string{}
-	for lng := range CodeBlocks {
-		langsList = append(langsList, lng)
-	}
-	langs := strings.Join(langsList, "|")
-
-	reBlk := regexp.MustCompile("(?sU)```[\t ]?(" + langs + ")[\t ]?[\n\r]+.+[\n\r]```[\n\r]?")
-	reLng := regexp.MustCompile("^.+")
+	reBlk := regexp.MustCompile("(?sU)```[\t ]?" + langTagsRegex() + "([\t ][^\n\r]*)?[\n\r]+(.+)[\n\r]```[\n\r]?")
 
-	blocks := map[string]string{}
+	blocks := map[string]CodeBlock{}
 
-	for _, v := range reBlk.FindAllString(body, -1) {
-		s := strings.Trim(v, blankRunes)
-		s = strings.Trim(s, "`")
-		s = strings.Trim(s, blankRunes)
-		lang := reLng.FindString(s)
-		if lang == "" {
+	for _, m := range reBlk.FindAllStringSubmatch(body, -1) {
+		lang, ok := langByTag(m[1])
+		if !ok {
+			continue
+		}
+		info := parseBlockInfo(m[2])
+		s := strings.Trim(m[3], blankRunes)
+		if s == "" {
 			continue
 		}
-		s = strings.Trim(s[len(lang):], blankRunes)
+		b := CodeBlock{Lang: lang, Name: info["name"], Code: s}
+		k := b.Key()
 		// The first block of this type
-		if blocks[lang] == "" {
-			blocks[lang] = s
+		if old, ok := blocks[k]; !ok {
+			blocks[k] = b
 		} else {
-			blocks[lang] += "\n\n" + s
+			old.Code += "\n\n" + s
+			blocks[k] = old
 		}
 	}
 
 	return blocks
 }
 
+// parseBlockInfo extracts the attributes from the info string of a block,
+// eg: ```py name=collector => {name: collector}
+// Invalid attribute values are ignored.
+func parseBlockInfo(info string) map[string]string {
+	reVal := regexp.MustCompile(`^[\w-]+$`)
+	attrs := map[string]string{}
+	for _, field := range strings.Fields(info) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		v := strings.Trim(kv[1], `"'`)
+		if reVal.MatchString(v) {
+			attrs[kv[0]] = v
+		}
+	}
+	return attrs
+}
+
 // The "this file was generated by Trinkets-Spinal" warning message
 func codeGeneratedByMsg(lang string) (str string) {
-	cmt := CodeBlocks[lang].Comment
-	if lang == "py" {
-		str += "#!/usr/bin/env python3\n"
+	t := CodeBlocks[lang]
+	cmt := t.Comment
+	if cmt == "" {
+		cmt = "#"
+	}
+	if t.Shebang != "" {
+		str += t.Shebang + "\n"
 	}
 	str += cmt + " THIS FILE IS GENERATED by Trinkets-Spinal\n"
 	str += cmt + " Don't edit; Your changes will be overwritten!"
@@ -60,18 +85,85 @@ func codeGeneratedByMsg(lang string) (str string) {
 
 // codeLangHeader creates a hash-map called `spinal` = {id, db, log, etc}
 // for each language.
+// For shell, the header is exported as variables, eg: SPINAL_ID,
+// and as JSON in SPINAL_JSON.
+// For the other languages, the header is just a comment.
 func codeLangHeader(front FrontMatter, lang string) (str string) {
 	body, _ := json.MarshalIndent(front, "", "  ")
-	if lang == "js" {
+	if lang == "js" || lang == "mjs" {
 		str = "const spinal = " + string(body)
 	} else if lang == "py" {
 		str = "true = True; false = False; null = None\n"
 		str += "spinal = " + string(body)
+	} else if lang == "sh" || lang == "zsh" {
+		str = shellExports(front)
+	} else {
+		cmt := CodeBlocks[lang].Comment
+		if cmt == "" {
+			cmt = "#"
+		}
+		body, _ = json.Marshal(front)
+		str = cmt + " spinal = " + string(body)
 	}
 	return
 }
 
-// codeLangImports creates the DB and LOG imports for each language.
+// shellExports flattens the front matter into exported variables,
+// eg: meta.servers[0].host => SPINAL_META_SERVERS_0_HOST,
+// sorted by name; the null values are skipped.
+func shellExports(front FrontMatter) string {
+	body, _ := json.Marshal(front)
+	var tree interface{}
+	json.Unmarshal(body, &tree)
+
+	vars := map[string]string{}
+	flattenVars("SPINAL", tree, vars)
+	names := []string{}
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := []string{"export SPINAL_JSON=" + shellQuote(string(body))}
+	for _, name := range names {
+		lines = append(lines, "export "+name+"="+shellQuote(vars[name]))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// flattenVars adds the leaf values of a JSON tree, by variable name
+func flattenVars(prefix string, node interface{}, vars map[string]string) {
+	switch v := node.(type) {
+	case nil:
+	case map[string]interface{}:
+		for key, child := range v {
+			flattenVars(prefix+"_"+varName(key), child, vars)
+		}
+	case []interface{}:
+		for i, child := range v {
+			flattenVars(fmt.Sprintf("%s_%d", prefix, i), child, vars)
+		}
+	case string:
+		vars[prefix] = v
+	default:
+		text, _ := json.Marshal(v)
+		vars[prefix] = string(text)
+	}
+}
+
+// varName converts a key into a shell variable name, eg: delayStart => DELAYSTART
+func varName(key string) string {
+	reInvalid := regexp.MustCompile(`[^A-Z0-9_]`)
+	return reInvalid.ReplaceAllString(strings.ToUpper(key), "_")
+}
+
+// shellQuote quotes a value for the shell, with single quotes
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// codeLangImports creates the DB and LOG imports for each language,
+// and the Spinal client: spinal.kv, spinal.log and spinal.state.
 func codeLangImports(front FrontMatter, lang string) (str string) {
 	if lang == "js" {
 		str = ""
@@ -85,6 +177,7 @@ func codeLangImports(front FrontMatter, lang string) (str string) {
 			str += ("\n" + logCode(front, lang) + "\n")
 		}
 		str += "const trigger = require('trinkets/triggers');\n"
+		str += clientCode(lang) + "\n"
 	} else if lang == "mjs" {
 		str = ""
 		if front.Db || front.Log {
@@ -96,9 +189,13 @@ func codeLangImports(front FrontMatter, lang string) (str string) {
 		if front.Log {
 			str += ("\n" + logCode(front, lang) + "\n")
 		}
+		str += clientCode(lang) + "\n"
 	} else if lang == "py" {
 		str = "import functools\n"
 		str += "print = functools.partial(print, flush=True)\n"
+		str += clientCode(lang) + "\n"
+	} else if lang == "sh" || lang == "zsh" {
+		str = clientCode(lang) + "\n"
 	}
 	return
 }
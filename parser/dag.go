@@ -0,0 +1,223 @@
+// File dag.go contains helpers to order the recipes,
+// by the dependencies declared with "needs".
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	yml "gopkg.in/yaml.v3"
+)
+
+// Conditions for the needed recipes
+const (
+	NeedStarted   = "started"   // all procs were started (default)
+	NeedHealthy   = "healthy"   // all procs pass the health checks
+	NeedCompleted = "completed" // all procs are tasks that finished OK
+)
+
+// Need is a dependency on another recipe, by ID
+type Need struct {
+	ID        string `yaml:"id" json:"id"`
+	Condition string `yaml:"condition,omitempty" json:"condition,omitempty"`
+}
+
+// Needs is a list of dependencies.
+// In YAML, it can be a list of IDs: [setup, collector:healthy],
+// a list of objects: [{id: setup, condition: completed}],
+// or an object: {setup: completed, collector: healthy}
+type Needs []Need
+
+// UnmarshalYAML accepts all the forms of needs
+func (n *Needs) UnmarshalYAML(value *yml.Node) error {
+	needs := Needs{}
+	switch value.Kind {
+	case yml.SequenceNode:
+		for _, item := range value.Content {
+			if item.Kind == yml.ScalarNode {
+				needs = append(needs, parseNeed(item.Value))
+				continue
+			}
+			need := Need{}
+			if err := item.Decode(&need); err != nil {
+				return err
+			}
+			needs = append(needs, need)
+		}
+	case yml.MappingNode:
+		for i := 0; i+1 < len(value.Content); i += 2 {
+			needs = append(needs, Need{
+				ID: value.Content[i].Value, Condition: value.Content[i+1].Value,
+			})
+		}
+	case yml.ScalarNode:
+		if value.Value != "" {
+			needs = append(needs, parseNeed(value.Value))
+		}
+	default:
+		return errors.New("invalid needs")
+	}
+	for i := range needs {
+		if needs[i].Condition == "" {
+			needs[i].Condition = NeedStarted
+		}
+	}
+	*n = needs
+	return nil
+}
+
+// parseNeed parses one need, as "id" or "id:condition"
+func parseNeed(text string) Need {
+	parts := strings.SplitN(text, ":", 2)
+	need := Need{ID: strings.TrimSpace(parts[0])}
+	if len(parts) > 1 {
+		need.Condition = strings.TrimSpace(parts[1])
+	}
+	return need
+}
+
+// validNeeds checks the needs of one recipe, without the other recipes
+func validNeeds(codFile CodeFile) error {
+	for _, need := range codFile.Needs {
+		if need.ID == "" {
+			return errors.New("empty needs ID")
+		}
+		if need.ID == codFile.ID {
+			return fmt.Errorf("recipe '%s' needs itself", need.ID)
+		}
+		switch need.Condition {
+		case NeedStarted, NeedHealthy, NeedCompleted:
+		default:
+			return fmt.Errorf("invalid needs condition '%s' for '%s'", need.Condition, need.ID)
+		}
+	}
+	return nil
+}
+
+// DropUnresolved removes the recipes that need a missing recipe, eg: disabled,
+// invalid, or that cannot be converted, and the recipes that need them.
+// From the recipes with the same ID, only the first by path is kept;
+// the recipes that need such an ID are removed, because it is ambiguous.
+// Returns the other recipes, and the error of each removed recipe, by path.
+func DropUnresolved(files []CodeFile) ([]CodeFile, map[string]error) {
+	paths := recipePaths(files)
+	dropped := map[string]error{}
+	for id, ps := range paths {
+		for _, p := range ps[1:] {
+			dropped[p] = fmt.Errorf("duplicate recipe ID '%s', already used by '%s'", id, ps[0])
+		}
+	}
+	droppedIDs := map[string]bool{}
+	for changed := true; changed; {
+		changed = false
+		for _, f := range files {
+			if _, exists := dropped[f.Path]; exists {
+				continue
+			}
+			for _, need := range f.Needs {
+				var err error
+				if droppedIDs[need.ID] {
+					err = fmt.Errorf("recipe '%s' needs recipe '%s', that was dropped", f.ID, need.ID)
+				} else if err = resolveNeed(f, need, paths); err == nil {
+					continue
+				}
+				dropped[f.Path] = err
+				droppedIDs[f.ID] = true
+				changed = true
+				break
+			}
+		}
+	}
+
+	kept := []CodeFile{}
+	for _, f := range files {
+		if _, exists := dropped[f.Path]; !exists {
+			kept = append(kept, f)
+		}
+	}
+	return kept, dropped
+}
+
+// recipePaths returns the paths of the recipes by ID, sorted
+func recipePaths(files []CodeFile) map[string][]string {
+	paths := map[string][]string{}
+	for _, f := range files {
+		paths[f.ID] = append(paths[f.ID], f.Path)
+	}
+	for _, ps := range paths {
+		sort.Strings(ps)
+	}
+	return paths
+}
+
+// resolveNeed checks that exactly one recipe has the needed ID
+func resolveNeed(f CodeFile, need Need, paths map[string][]string) error {
+	switch ps := paths[need.ID]; len(ps) {
+	case 0:
+		return fmt.Errorf("recipe '%s' needs unknown recipe '%s'", f.ID, need.ID)
+	case 1:
+		return nil
+	default:
+		return fmt.Errorf("recipe '%s' needs recipe '%s', that is ambiguous: %s",
+			f.ID, need.ID, strings.Join(ps, ", "))
+	}
+}
+
+// SortRecipes orders the recipes, so that each recipe comes after
+// the recipes it needs; the independent recipes are sorted by path.
+// The recipes can have the same ID, if no recipe needs that ID.
+// Returns an error if a needed recipe is missing or ambiguous,
+// or if the needs form a cycle.
+func SortRecipes(files []CodeFile) ([]CodeFile, error) {
+	paths := recipePaths(files)
+	byPath := map[string]CodeFile{}
+	for _, f := range files {
+		byPath[f.Path] = f
+		for _, need := range f.Needs {
+			if err := resolveNeed(f, need, paths); err != nil {
+				return nil, err
+			}
+		}
+	}
+	order := []string{}
+	for _, f := range files {
+		order = append(order, f.Path)
+	}
+	sort.Strings(order)
+
+	// Depth-first search, keeping the current path to report cycles
+	sorted := []CodeFile{}
+	done := map[string]bool{}
+	path := []string{}
+	var visit func(f CodeFile) error
+	visit = func(f CodeFile) error {
+		if done[f.Path] {
+			return nil
+		}
+		for i, p := range path {
+			if p == f.ID {
+				cycle := append(append([]string{}, path[i:]...), f.ID)
+				return errors.New("dependency cycle: " + strings.Join(cycle, " -> "))
+			}
+		}
+		path = append(path, f.ID)
+		for _, need := range f.Needs {
+			if err := visit(byPath[paths[need.ID][0]]); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		done[f.Path] = true
+		sorted = append(sorted, f)
+		return nil
+	}
+
+	for _, p := range order {
+		if err := visit(byPath[p]); err != nil {
+			return nil, err
+		}
+	}
+	return sorted, nil
+}
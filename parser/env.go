@@ -0,0 +1,177 @@
+package parser
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ShinyTrinkets/spinal/secrets"
+	yml "gopkg.in/yaml.v3"
+)
+
+// EnvVars are the environment variables of the procs, as KEY=value.
+// In YAML, they are a list of KEY=value, or a map of KEY: value.
+// A KEY without value is copied from the parent environment.
+type EnvVars []string
+
+// UnmarshalYAML accepts the list and the map forms
+func (e *EnvVars) UnmarshalYAML(value *yml.Node) error {
+	vars := EnvVars{}
+	switch value.Kind {
+	case yml.SequenceNode:
+		for _, item := range value.Content {
+			if item.Kind != yml.ScalarNode {
+				return errors.New("invalid env: the list items must be KEY=value")
+			}
+			vars = append(vars, item.Value)
+		}
+	case yml.MappingNode:
+		for i := 0; i+1 < len(value.Content); i += 2 {
+			vars = append(vars, value.Content[i].Value+"="+value.Content[i+1].Value)
+		}
+	case yml.ScalarNode:
+		if value.Value != "" {
+			return errors.New("invalid env: must be a list, or a map")
+		}
+	default:
+		return errors.New("invalid env")
+	}
+	*e = vars
+	return nil
+}
+
+// envMap is an environment that keeps the order of the variables;
+// setting a variable again replaces the value, in place
+type envMap struct {
+	keys   []string
+	values map[string]string
+}
+
+func newEnvMap(env []string) *envMap {
+	m := &envMap{values: map[string]string{}}
+	for _, kv := range env {
+		key, value, _ := strings.Cut(kv, "=")
+		m.set(key, value)
+	}
+	return m
+}
+
+func (m *envMap) set(key, value string) {
+	if _, exists := m.values[key]; !exists {
+		m.keys = append(m.keys, key)
+	}
+	m.values[key] = value
+}
+
+// lookup returns the variable, or the variable from the parent environment
+func (m *envMap) lookup(key string) string {
+	if value, exists := m.values[key]; exists {
+		return value
+	}
+	value, _ := parentEnv(key)
+	return value
+}
+
+// parentEnv returns a variable from the parent environment,
+// except the key of the secrets, that the procs must not see
+func parentEnv(key string) (string, bool) {
+	if key == secrets.KeyEnv {
+		return "", false
+	}
+	return os.LookupEnv(key)
+}
+
+func (m *envMap) list() []string {
+	env := make([]string, 0, len(m.keys))
+	for _, key := range m.keys {
+		env = append(env, key+"="+m.values[key])
+	}
+	return env
+}
+
+// ProcEnv returns the environment of the procs: the parent environment
+// without the key of the secrets, or an empty environment with clean_env,
+// then the variables from the env_file, relative to the recipe, then the env variables.
+// The ${VAR} references are replaced from the variables defined before,
+// or from the parent environment.
+func (fm FrontMatter) ProcEnv(recipe string) ([]string, error) {
+	m := newEnvMap(nil)
+	if !fm.CleanEnv {
+		for _, kv := range os.Environ() {
+			key, value, _ := strings.Cut(kv, "=")
+			if _, ok := parentEnv(key); ok {
+				m.set(key, value)
+			}
+		}
+	}
+
+	if fm.EnvFile != "" {
+		fname := fm.EnvFile
+		if !filepath.IsAbs(fname) {
+			fname = filepath.Join(filepath.Dir(recipe), fname)
+		}
+		if err := readEnvFile(fname, m); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, kv := range fm.Env {
+		key, value, found := strings.Cut(kv, "=")
+		key = strings.TrimSpace(key)
+		if key == "" {
+			return nil, fmt.Errorf("invalid env: '%s'", kv)
+		}
+		if !found {
+			if value, exists := parentEnv(key); exists {
+				m.set(key, value)
+			}
+			continue
+		}
+		m.set(key, os.Expand(value, m.lookup))
+	}
+	return m.list(), nil
+}
+
+// readEnvFile reads a dotenv file: KEY=value lines, with optional
+// export prefix and # comments. The values in single quotes are literal;
+// the other values are interpolated, and double quotes allow \n escapes.
+func readEnvFile(fname string, m *envMap) error {
+	f, err := os.Open(fname)
+	if err != nil {
+		return fmt.Errorf("cannot read env file: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		key, value, found := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !found || key == "" {
+			return fmt.Errorf("invalid env file '%s', line %d", fname, n)
+		}
+		value = strings.TrimSpace(value)
+
+		switch {
+		case len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'':
+			m.set(key, value[1:len(value)-1])
+			continue
+		case len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"':
+			value = strings.NewReplacer(`\n`, "\n", `\"`, `"`, `\\`, `\`).Replace(value[1 : len(value)-1])
+		default:
+			// A comment after the value
+			if i := strings.Index(value, " #"); i >= 0 {
+				value = strings.TrimSpace(value[:i])
+			}
+		}
+		m.set(key, os.Expand(value, m.lookup))
+	}
+	return scanner.Err()
+}
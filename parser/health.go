@@ -0,0 +1,114 @@
+// File health.go contains the health checks of the recipes,
+// declared with "health" in the front matter.
+package parser
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// The health check defaults
+const (
+	defaultHealthInterval = 10 * time.Second
+	defaultHealthTimeout  = 2 * time.Second
+	defaultHealthRetries  = 3
+)
+
+// Health represents the health checks of a recipe.
+// All the defined probes must pass, for the recipe to be healthy.
+type Health struct {
+	// HTTP GET, expecting a 2xx or 3xx status, eg: ":8080/health"
+	HTTP string `yaml:"http,omitempty" json:"http,omitempty"`
+	// TCP port that must accept connections, eg: ":5432"
+	TCP string `yaml:"tcp,omitempty" json:"tcp,omitempty"`
+	// Shell command that must exit with code 0
+	Exec string `yaml:"exec,omitempty" json:"exec,omitempty"`
+	// KV key that must be updated regularly
+	KV *KVHealth `yaml:"kv,omitempty" json:"kv,omitempty"`
+	// How often to check
+	Interval time.Duration `yaml:"interval,omitempty" json:"interval,omitempty"`
+	// How long to wait for one check
+	Timeout time.Duration `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	// Consecutive failures, before the recipe is unhealthy
+	Retries uint `yaml:"retries,omitempty" json:"retries,omitempty"`
+	// Restart the procs, when the recipe is unhealthy
+	Restart bool `yaml:"restart,omitempty" json:"restart,omitempty"`
+}
+
+// KVHealth is a check for a key from the KV store,
+// that must be updated within the given duration.
+// Without a store, the store with the ID of the recipe is used.
+type KVHealth struct {
+	Store  string        `yaml:"store,omitempty" json:"store,omitempty"`
+	Key    string        `yaml:"key" json:"key"`
+	Within time.Duration `yaml:"within" json:"within"`
+}
+
+// Every returns the interval between checks
+func (h *Health) Every() time.Duration {
+	if h.Interval > 0 {
+		return h.Interval
+	}
+	return defaultHealthInterval
+}
+
+// TimeLimit returns the timeout of one check, never longer than the interval
+func (h *Health) TimeLimit() time.Duration {
+	timeout := defaultHealthTimeout
+	if h.Timeout > 0 {
+		timeout = h.Timeout
+	}
+	if timeout > h.Every() {
+		return h.Every()
+	}
+	return timeout
+}
+
+// MaxFailures returns the number of consecutive failures,
+// before the recipe is unhealthy
+func (h *Health) MaxFailures() uint {
+	if h.Retries > 0 {
+		return h.Retries
+	}
+	return defaultHealthRetries
+}
+
+// HTTPAddr returns the full URL of the HTTP check;
+// the host defaults to localhost, eg: ":8080/health"
+func (h *Health) HTTPAddr() string {
+	addr := h.HTTP
+	if strings.HasPrefix(addr, "http://") || strings.HasPrefix(addr, "https://") {
+		return addr
+	}
+	if strings.HasPrefix(addr, ":") || strings.HasPrefix(addr, "/") {
+		return "http://localhost" + addr
+	}
+	return "http://" + addr
+}
+
+// TCPAddr returns the address of the TCP check;
+// the host defaults to localhost, eg: ":5432"
+func (h *Health) TCPAddr() string {
+	if strings.HasPrefix(h.TCP, ":") {
+		return "localhost" + h.TCP
+	}
+	if !strings.Contains(h.TCP, ":") {
+		return "localhost:" + h.TCP
+	}
+	return h.TCP
+}
+
+// validHealth checks the health checks of one recipe
+func validHealth(h *Health) error {
+	if h == nil {
+		return nil
+	}
+	if h.HTTP == "" && h.TCP == "" && h.Exec == "" && h.KV == nil {
+		return errors.New("health check without probes")
+	}
+	if h.KV != nil && (h.KV.Key == "" || h.KV.Within <= 0) {
+		return errors.New("health check KV needs a key and a duration")
+	}
+	return nil
+}
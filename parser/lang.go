@@ -0,0 +1,240 @@
+// File lang.go contains the registry of known languages,
+// and helpers to find the language of a code block,
+// or to render the commands that build and run a generated file.
+package parser
+
+import (
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// CodeType describes a language: how the code blocks are recognized,
+// how the generated files look, how they are built and executed.
+type CodeType struct {
+	Name       string   `yaml:"name,omitempty"`
+	Tags       []string `yaml:"tags,omitempty"`       // fence tags, eg: py, python
+	Ext        string   `yaml:"ext,omitempty"`        // generated file extension
+	Executable string   `yaml:"executable,omitempty"` // eg: python3
+	Args       []string `yaml:"args,omitempty"`       // args templates, eg: {{.File}}
+	Comment    string   `yaml:"comment,omitempty"`    // line comment prefix
+	Shebang    string   `yaml:"shebang,omitempty"`    // first line of the generated file
+	Build      []string `yaml:"build,omitempty"`      // build command templates (optional)
+	Artifact   string   `yaml:"artifact,omitempty"`   // build output template, eg: {{.Base}}
+}
+
+// The data available in the Executable, Args, Build and Artifact templates
+type cmdData struct {
+	File     string // the generated file, relative to the working dir
+	Base     string // the generated file, without extension
+	Artifact string // the build output, relative to the working dir
+	ID       string // the ID of the recipe
+}
+
+// The arguments used when the Args are not defined
+var defaultArgs = []string{"{{.File}}"}
+
+// The build output used when the Artifact is not defined
+const defaultArtifact = "{{.Base}}"
+
+// The built-in languages; they can be extended from the config,
+// eg: the compiled languages, in examples/config.yaml
+var defaultCodeBlocks = map[string]CodeType{
+	"js":  {Name: "Javascript", Executable: "node", Comment: "//"}, // CommonJS
+	"mjs": {Name: "Javascript", Executable: "node", Comment: "//"}, // ES Modules
+	"py":  {Name: "Python", Executable: "python3", Comment: "#", Shebang: "#!/usr/bin/env python3"},
+	"sh":  {Name: "Bash", Executable: "bash", Comment: "#"},
+	"zsh": {Name: "ZSH", Executable: "zsh", Comment: "#"},
+}
+
+// All known code block types, by language key
+var CodeBlocks = mergeLanguages(nil)
+
+// LoadLanguages merges the languages over the built-in defaults,
+// and replaces the registry of known languages.
+// The fields defined for a language replace the default fields,
+// the missing fields are kept from the defaults.
+func LoadLanguages(langs map[string]CodeType) {
+	CodeBlocks = mergeLanguages(langs)
+}
+
+func mergeLanguages(langs map[string]CodeType) map[string]CodeType {
+	reg := map[string]CodeType{}
+	for key, t := range defaultCodeBlocks {
+		reg[key] = t.withDefaults(key)
+	}
+	for key, t := range langs {
+		reg[key] = reg[key].merge(t).withDefaults(key)
+	}
+	return reg
+}
+
+// merge returns a copy of the language, overwritten with the non-empty fields
+func (t CodeType) merge(o CodeType) CodeType {
+	if o.Name != "" {
+		t.Name = o.Name
+	}
+	if len(o.Tags) > 0 {
+		t.Tags = o.Tags
+	}
+	if o.Ext != "" {
+		t.Ext = o.Ext
+	}
+	if o.Executable != "" {
+		t.Executable = o.Executable
+	}
+	if len(o.Args) > 0 {
+		t.Args = o.Args
+	}
+	if o.Comment != "" {
+		t.Comment = o.Comment
+	}
+	if o.Shebang != "" {
+		t.Shebang = o.Shebang
+	}
+	if len(o.Build) > 0 {
+		t.Build = o.Build
+	}
+	if o.Artifact != "" {
+		t.Artifact = o.Artifact
+	}
+	return t
+}
+
+// withDefaults fills the missing fields of a language
+func (t CodeType) withDefaults(key string) CodeType {
+	if t.Name == "" {
+		t.Name = key
+	}
+	if len(t.Tags) == 0 {
+		t.Tags = []string{key}
+	}
+	if t.Ext == "" {
+		t.Ext = key
+	}
+	if t.Comment == "" {
+		t.Comment = "#"
+	}
+	if len(t.Build) > 0 {
+		// Compiled languages run the artifact, without args
+		if t.Artifact == "" {
+			t.Artifact = defaultArtifact
+		}
+	} else if len(t.Args) == 0 {
+		t.Args = defaultArgs
+	}
+	return t
+}
+
+// Cmd returns the executable and the rendered arguments,
+// used to run a generated file.
+// For compiled languages, the default executable is the build artifact.
+func (t CodeType) Cmd(file string, front FrontMatter) (string, []string, error) {
+	data, err := t.cmdData(file, front)
+	if err != nil {
+		return "", nil, err
+	}
+	exe := t.Executable
+	if exe == "" && data.Artifact != "" {
+		exe = data.Artifact
+		if !strings.Contains(exe, "/") {
+			// Avoid looking for the artifact in the PATH
+			exe = "./" + exe
+		}
+	}
+	if exe, err = renderCmd(exe, data); err != nil {
+		return "", nil, err
+	}
+	args, err := renderCmdList(t.Args, data)
+	return exe, args, err
+}
+
+// BuildCmd returns the rendered build command, and the build artifact,
+// used to compile a generated file.
+// If the language doesn't need a build, the command is empty.
+func (t CodeType) BuildCmd(file string, front FrontMatter) ([]string, string, error) {
+	if len(t.Build) == 0 {
+		return nil, "", nil
+	}
+	data, err := t.cmdData(file, front)
+	if err != nil {
+		return nil, "", err
+	}
+	args, err := renderCmdList(t.Build, data)
+	return args, data.Artifact, err
+}
+
+// cmdData prepares the data for rendering the command templates
+func (t CodeType) cmdData(file string, front FrontMatter) (cmdData, error) {
+	data := cmdData{
+		File: file,
+		Base: strings.TrimSuffix(file, filepath.Ext(file)),
+		ID:   front.ID,
+	}
+	if len(t.Build) > 0 {
+		artifact, err := renderCmd(t.Artifact, data)
+		if err != nil {
+			return data, err
+		}
+		data.Artifact = artifact
+	}
+	return data, nil
+}
+
+// renderCmd renders one command template
+func renderCmd(str string, data cmdData) (string, error) {
+	tmpl, err := template.New(data.ID).Parse(str)
+	if err != nil {
+		return "", err
+	}
+	builder := &strings.Builder{}
+	if err := tmpl.Execute(builder, data); err != nil {
+		return "", err
+	}
+	return builder.String(), nil
+}
+
+// renderCmdList renders a list of command templates
+func renderCmdList(list []string, data cmdData) ([]string, error) {
+	args := []string{}
+	for _, arg := range list {
+		s, err := renderCmd(arg, data)
+		if err != nil {
+			return args, err
+		}
+		args = append(args, s)
+	}
+	return args, nil
+}
+
+// langByTag returns the language key for a fence tag
+func langByTag(tag string) (string, bool) {
+	for key, t := range CodeBlocks {
+		for _, tg := range t.Tags {
+			if tg == tag {
+				return key, true
+			}
+		}
+	}
+	return "", false
+}
+
+// langTagsRegex returns the fence tags of all languages, as a regex group.
+// Longer tags go first, so they are preferred over their prefixes.
+func langTagsRegex() string {
+	tags := []string{}
+	for _, t := range CodeBlocks {
+		for _, tg := range t.Tags {
+			tags = append(tags, regexp.QuoteMeta(tg))
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		if len(tags[i]) != len(tags[j]) {
+			return len(tags[i]) > len(tags[j])
+		}
+		return tags[i] < tags[j]
+	})
+	return "(" + strings.Join(tags, "|") + ")"
+}
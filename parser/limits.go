@@ -0,0 +1,84 @@
+// File limits.go contains the resource limits of the procs,
+// declared with "limits" in the front matter.
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	yml "gopkg.in/yaml.v3"
+)
+
+// Limits represents the resources of each proc of a recipe.
+// The open files and the processes are limited with rlimits;
+// the memory, the CPU and the processes are limited with cgroup v2,
+// when available. Without cgroups, the memory and the CPU are not limited,
+// and they are reported as unenforced in the StateTree.
+type Limits struct {
+	// Memory, in bytes, or with a unit, eg: "512M", "1G"
+	Memory Size `yaml:"memory,omitempty" json:"memory,omitempty"`
+	// CPU share, as a number of CPUs, eg: 0.5
+	CPU float64 `yaml:"cpu,omitempty" json:"cpu,omitempty"`
+	// Max open files
+	Files uint64 `yaml:"files,omitempty" json:"files,omitempty"`
+	// Max processes and threads; the rlimit counts all the procs of the user
+	Procs uint64 `yaml:"procs,omitempty" json:"procs,omitempty"`
+	// Wall-clock time of one run, after which the proc is killed
+	Timeout time.Duration `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+}
+
+// Size is a number of bytes. In YAML, the size can have
+// a binary unit: K, M, G, or T, eg: "512M", "1.5GiB"
+type Size int64
+
+// UnmarshalYAML accepts the numbers, and the sizes with units
+func (s *Size) UnmarshalYAML(value *yml.Node) error {
+	size, err := ParseSize(value.Value)
+	if err != nil {
+		return err
+	}
+	*s = size
+	return nil
+}
+
+// ParseSize converts a size with an optional unit to bytes
+func ParseSize(text string) (Size, error) {
+	str := strings.ToUpper(strings.TrimSpace(text))
+	str = strings.TrimSuffix(strings.TrimSuffix(str, "B"), "I")
+	mult := float64(1)
+	if n := len(str); n > 0 {
+		if i := strings.IndexByte("KMGT", str[n-1]); i >= 0 {
+			mult = float64(int64(1) << (10 * (i + 1)))
+			str = strings.TrimSpace(str[:n-1])
+		}
+	}
+	num, err := strconv.ParseFloat(str, 64)
+	if err != nil || num < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", text)
+	}
+	return Size(num * mult), nil
+}
+
+// IsEmpty returns true if no limit is defined
+func (l *Limits) IsEmpty() bool {
+	return l == nil || (l.Memory == 0 && l.CPU == 0 && l.Files == 0 && l.Procs == 0 && l.Timeout == 0)
+}
+
+func validLimits(l *Limits) error {
+	if l == nil {
+		return nil
+	}
+	if l.Memory < 0 || l.CPU < 0 || l.Timeout < 0 {
+		return errors.New("invalid limits: negative values")
+	}
+	if l.Memory > 0 && l.Memory < 1024*1024 {
+		return errors.New("invalid limits: the memory must be at least 1M")
+	}
+	if l.CPU > 0 && l.CPU < 0.01 {
+		return errors.New("invalid limits: the CPU must be at least 0.01")
+	}
+	return nil
+}
@@ -12,7 +12,10 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 
+	"github.com/ShinyTrinkets/spinal/schedule"
+	"github.com/ShinyTrinkets/spinal/secrets"
 	util "github.com/ShinyTrinkets/spinal/util"
 	yml "gopkg.in/yaml.v3"
 )
@@ -22,13 +25,16 @@ import (
 // ConvertFolder finds all candidate code-files from a folder,
 // and generates source code.
 // The original text files are not changed.
-func ConvertFolder(dir string) (map[string]StringToString, map[string]CodeFile, error) {
+// The recipes that need a missing or ambiguous recipe, and the recipes
+// with a duplicate ID, are dropped, with their error, by path.
+func ConvertFolder(dir string) (map[string]StringToString, map[string]CodeFile, map[string]error, error) {
 	pairs := map[string]StringToString{}
 	okFiles := map[string]CodeFile{}
+	dropped := map[string]error{}
 
 	files, err := ParseFolder(dir, true)
 	if err != nil {
-		return pairs, okFiles, err
+		return pairs, okFiles, dropped, err
 	}
 
 	for _, p := range files {
@@ -40,7 +46,21 @@ func ConvertFolder(dir string) (map[string]StringToString, map[string]CodeFile,
 		pairs[p.Path] = outFiles
 		okFiles[p.Path] = p
 	}
-	return pairs, okFiles, nil
+
+	// The dependencies between recipes must be valid
+	converted := []CodeFile{}
+	for _, p := range okFiles {
+		converted = append(converted, p)
+	}
+	converted, dropped = DropUnresolved(converted)
+	for path := range dropped {
+		delete(pairs, path)
+		delete(okFiles, path)
+	}
+	if _, err := SortRecipes(converted); err != nil {
+		return pairs, okFiles, dropped, err
+	}
+	return pairs, okFiles, dropped, nil
 }
 
 // ParseFolder finds all candidate code-files from a folder,
@@ -81,18 +101,57 @@ func ParseFolder(dir string, checkInvalid bool) ([]CodeFile, error) {
 			}
 		}
 		// resolve path relative to current dir
-		if strings.Index(p.Path, cwd) == 0 {
-			p.Path, err = filepath.Rel(cwd, p.Path)
-			if err != nil {
-				// Error if target path can't be made relative to basepath
-				continue // => safe to ignore
-			}
+		p.Path, err = relToCwd(p.Path, cwd)
+		if err != nil {
+			// Error if target path can't be made relative to basepath
+			continue // => safe to ignore
 		}
 		files = append(files, p)
 	}
 	return files, nil
 }
 
+// ScanFolder finds all candidate code-files from a folder,
+// and returns their modification times.
+// The paths are resolved the same way as in ParseFolder,
+// so they can be used to compare with the parsed files.
+func ScanFolder(dir string) (map[string]time.Time, error) {
+	files := map[string]time.Time{}
+
+	filesStr, err := listCodeFiles(strings.TrimRight(dir, "/"), 0)
+	if err != nil {
+		return files, err
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return files, err
+	}
+
+	for _, fname := range filesStr {
+		_, mtime, err := util.FileStats(fname)
+		if err != nil {
+			// The file was removed in the mean time
+			continue
+		}
+		fname, err = relToCwd(fname, cwd)
+		if err != nil {
+			continue
+		}
+		files[fname] = mtime
+	}
+	return files, nil
+}
+
+// relToCwd resolves the path relative to current dir,
+// if the path is inside the current dir.
+func relToCwd(path string, cwd string) (string, error) {
+	if strings.Index(path, cwd) == 0 {
+		return filepath.Rel(cwd, path)
+	}
+	return path, nil
+}
+
 // listCodeFiles returns all candidate code-files from a folder.
 // Candidate files should contain fenced code blocks.
 // This list can be used to parse the files,
@@ -135,6 +194,7 @@ func listCodeFiles(folder string, scanDepth int) ([]string, error) {
 }
 
 // ConvertFile generates 1 or more code files, from one code file.
+// The result will be in the form: {block key => generated file}
 // Force=true will convert a file without checking the header.
 func ConvertFile(codFile CodeFile, force bool) (StringToString, error) {
 	outFiles := StringToString{}
@@ -153,30 +213,66 @@ func ConvertFile(codFile CodeFile, force bool) (StringToString, error) {
 		return outFiles, errors.New("file has no blocks of code: " + fName)
 	}
 
-	front := FrontMatter{codFile.Enabled, codFile.ID,
-		codFile.Db, codFile.Log,
-		codFile.Cwd, codFile.Env,
-		codFile.DelayStart,
-		codFile.RetryTimes,
-		codFile.Meta}
+	// The schedule must be valid, to be able to run
+	if codFile.Schedule != "" {
+		if _, err := schedule.Parse(codFile.Schedule); err != nil {
+			return outFiles, errors.New(err.Error() + ": " + fName)
+		}
+	}
+	switch codFile.Overlap {
+	case "", OverlapSkip, OverlapQueue, OverlapKill:
+	default:
+		return outFiles, errors.New("invalid overlap policy '" + codFile.Overlap + "': " + fName)
+	}
+
+	switch codFile.Kind {
+	case "", KindTask, KindService:
+	default:
+		return outFiles, errors.New("invalid kind '" + codFile.Kind + "': " + fName)
+	}
+	switch codFile.Restart {
+	case "", RestartNever, RestartOnFailure, RestartAlways:
+	default:
+		return outFiles, errors.New("invalid restart policy '" + codFile.Restart + "': " + fName)
+	}
+
+	if err := validNeeds(codFile); err != nil {
+		return outFiles, errors.New(err.Error() + ": " + fName)
+	}
+	if err := validHealth(codFile.Health); err != nil {
+		return outFiles, errors.New(err.Error() + ": " + fName)
+	}
+	if err := validLimits(codFile.Limits); err != nil {
+		return outFiles, errors.New(err.Error() + ": " + fName)
+	}
+	for _, name := range codFile.Secrets {
+		if err := secrets.ValidName(name); err != nil {
+			return outFiles, errors.New(err.Error() + ": " + fName)
+		}
+	}
+
+	front := codFile.FrontMatter
 
 	baseLen := len(fName) - len(filepath.Ext(fName))
 
-	for lang, code := range codFile.Blocks {
-		outFile := fName[:baseLen] + "." + lang
+	for key, block := range codFile.Blocks {
+		lang := block.Lang
+		outFile := fName[:baseLen] + "." + block.FileExt()
 		if fName == outFile {
 			// Overwrite the source file ?!
 			// This should never happen
 			continue
 		}
-		code = codeGeneratedByMsg(lang) + "\n\n" +
+		code := codeGeneratedByMsg(lang) + "\n\n" +
 			codeLangHeader(front, lang) + "\n" +
-			codeLangImports(front, lang) + "\n" + code
-		err := ioutil.WriteFile(outFile, []byte(code), 0644)
+			codeLangImports(front, lang) + "\n" + block.Code
+		// The file is not touched if the code didn't change,
+		// so the compiled languages can skip the build
+		err := writeIfChanged(outFile, code)
 		if err != nil {
 			return outFiles, err
 		}
-		outFiles[lang] = outFile
+		outFiles[key] = outFile
 	} // for each block of code
 	return outFiles, nil
 }
@@ -196,7 +292,7 @@ func ParseFile(fname string) CodeFile {
 	}
 
 	fm := FrontMatter{}
-	blocks := StringToString{}
+	blocks := map[string]CodeBlock{}
 	parseFile = CodeFile{fm, fname, ctime, mtime, blocks}
 
 	text, err := ioutil.ReadFile(fname)
@@ -2,10 +2,17 @@ package parser
 
 import (
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/ShinyTrinkets/spinal/secrets"
+	util "github.com/ShinyTrinkets/spinal/util"
 	"github.com/stretchr/testify/assert"
 	"gopkg.in/yaml.v3"
 )
@@ -43,9 +50,12 @@ func TestParseBlocks(t *testing.T) {
 
 	for _, fixt := range fixtures {
 		blocks := ParseBlocks(fixt.Text)
+		if len(blocks) != len(fixt.Result) {
+			t.Fatalf("Resulted blocks = %v invalid ; expected = %v", len(blocks), len(fixt.Result))
+		}
 		for lang, code := range fixt.Result {
 			code = strings.Trim(code, blankRunes)
-			bloc := strings.Trim(blocks[lang], blankRunes)
+			bloc := strings.Trim(blocks[lang].Code, blankRunes)
 			if bloc != code {
 				t.Fatalf("Resulted block = `%v` invalid ; expected = `%v`", bloc, code)
 			}
@@ -87,3 +97,424 @@ func TestListCodeFiles(t *testing.T) {
 	assert.Equal(len(files), len(srcFiles)+2, "There should be %v code files != %v", len(srcFiles)+2, len(files))
 	assert.Nil(err)
 }
+
+func TestScanFolder(t *testing.T) {
+	assert := assert.New(t)
+	files, err := ScanFolder("testdata/deep1/")
+	assert.Nil(err, "Cannot scan code files")
+	listed, _ := listCodeFiles("testdata/deep1/", 0)
+	assert.Equal(len(listed), len(files))
+
+	// The paths are relative, like in ParseFolder
+	fname := "testdata/deep1/deep_file1.md"
+	assert.Contains(files, fname)
+	_, mtime, _ := util.FileStats(fname)
+	assert.True(mtime.Equal(files[fname]))
+}
+
+func TestParseNamedBlocks(t *testing.T) {
+	assert := assert.New(t)
+	text := "```py name=collector\ncollect()\n```\n" +
+		"```py\nprint(1)\n```\n" +
+		"```py name=reporter\nreport()\n```\n" +
+		"```py name=collector\ncollect_more()\n```\n"
+	blocks := ParseBlocks(text)
+	assert.Equal(3, len(blocks))
+
+	assert.Equal(CodeBlock{"py", "", "print(1)"}, blocks["py"])
+	assert.Equal(CodeBlock{"py", "collector", "collect()\n\ncollect_more()"}, blocks["collector.py"])
+	assert.Equal(CodeBlock{"py", "reporter", "report()"}, blocks["reporter.py"])
+
+	// Invalid names are ignored
+	blocks = ParseBlocks("```js name=../x\nconsole.log(1)\n```\n")
+	assert.Equal("", blocks["js"].Name)
+}
+
+func TestLoadLanguages(t *testing.T) {
+	assert := assert.New(t)
+	defer LoadLanguages(nil)
+
+	// Unknown languages are ignored
+	blocks := ParseBlocks("```ruby\nputs 1\n```\n")
+	assert.Equal(0, len(blocks))
+
+	LoadLanguages(map[string]CodeType{
+		"rb": {Name: "Ruby", Tags: []string{"rb", "ruby"}, Executable: "ruby"},
+		"py": {Executable: "python3.11", Args: []string{"-u", "{{.File}}"}},
+	})
+
+	blocks = ParseBlocks("```ruby\nputs 1\n```\n```rb name=x\nputs 2\n```\n")
+	assert.Equal(CodeBlock{"rb", "", "puts 1"}, blocks["rb"])
+	assert.Equal(CodeBlock{"rb", "x", "puts 2"}, blocks["x.rb"])
+	assert.Equal("x.rb", blocks["x.rb"].FileExt())
+
+	exe, args, err := CodeBlocks["rb"].Cmd("x.rb", FrontMatter{ID: "x"})
+	assert.Nil(err)
+	assert.Equal("ruby", exe)
+	assert.Equal([]string{"x.rb"}, args)
+	assert.Equal("# THIS FILE IS GENERATED by Trinkets-Spinal\n"+
+		"# Don't edit; Your changes will be overwritten!", codeGeneratedByMsg("rb"))
+
+	// The missing fields are kept from the defaults
+	py := CodeBlocks["py"]
+	assert.Equal("Python", py.Name)
+	assert.Equal("#!/usr/bin/env python3", py.Shebang)
+	exe, args, err = py.Cmd("x.py", FrontMatter{ID: "x"})
+	assert.Nil(err)
+	assert.Equal("python3.11", exe)
+	assert.Equal([]string{"-u", "x.py"}, args)
+}
+
+func TestBuildCmd(t *testing.T) {
+	assert := assert.New(t)
+	front := FrontMatter{ID: "x"}
+	defer LoadLanguages(nil)
+
+	// The compiled languages are defined in the example config
+	assert.Equal(0, len(CodeBlocks["go"].Build))
+	text, err := ioutil.ReadFile("../examples/config.yaml")
+	assert.Nil(err)
+	cfg := struct {
+		Languages map[string]CodeType `yaml:"languages"`
+	}{}
+	assert.Nil(yaml.Unmarshal(text, &cfg))
+	LoadLanguages(cfg.Languages)
+
+	// Interpreted languages don't need a build
+	args, artifact, err := CodeBlocks["py"].BuildCmd("x.py", front)
+	assert.Nil(err)
+	assert.Nil(args)
+	assert.Equal("", artifact)
+
+	// Compiled languages run the artifact
+	goLang := CodeBlocks["go"]
+	args, artifact, err = goLang.BuildCmd("x.collector.go", front)
+	assert.Nil(err)
+	assert.Equal([]string{"go", "build", "-o", "x.collector", "x.collector.go"}, args)
+	assert.Equal("x.collector", artifact)
+	exe, args, err := goLang.Cmd("x.collector.go", front)
+	assert.Nil(err)
+	assert.Equal("./x.collector", exe)
+	assert.Equal([]string{}, args)
+
+	goLang.Artifact = "bin/{{.ID}}"
+	exe, _, err = goLang.Cmd("x.go", front)
+	assert.Nil(err)
+	assert.Equal("bin/x", exe)
+}
+
+func TestConvertInvalidSchedule(t *testing.T) {
+	assert := assert.New(t)
+	p := CodeFile{Path: "testdata/x.md", Blocks: map[string]CodeBlock{"py": {"py", "", "pass"}}}
+	p.Enabled = true
+	p.ID = "x"
+
+	p.Schedule = "* * *"
+	_, err := ConvertFile(p, false)
+	assert.NotNil(err)
+
+	p.Schedule = "@every 10s"
+	p.Overlap = "sometimes"
+	_, err = ConvertFile(p, false)
+	assert.NotNil(err)
+	assert.False(util.IsFile("testdata/x.py"))
+}
+
+func TestRestartPolicy(t *testing.T) {
+	assert := assert.New(t)
+	f := FrontMatter{}
+	assert.Equal(RestartNever, f.RestartPolicy())
+	assert.Equal(KindService, f.ProcKind())
+
+	f.RetryTimes = 3
+	assert.Equal(RestartOnFailure, f.RestartPolicy())
+	f.Restart = RestartAlways
+	assert.Equal(RestartAlways, f.RestartPolicy())
+
+	f.Schedule = "@hourly"
+	assert.Equal(KindTask, f.ProcKind())
+	f.Kind = KindService
+	assert.Equal(KindService, f.ProcKind())
+
+	// Default backoff
+	assert.Equal(time.Second, f.Backoff.Duration(0))
+	assert.Equal(4*time.Second, f.Backoff.Duration(2))
+	assert.Equal(time.Minute, f.Backoff.Duration(10))
+
+	f.Backoff = &Backoff{Min: 100 * time.Millisecond, Max: time.Second, Factor: 3}
+	assert.Equal(300*time.Millisecond, f.Backoff.Duration(1))
+	assert.Equal(time.Second, f.Backoff.Duration(5))
+}
+
+func TestParseRestart(t *testing.T) {
+	assert := assert.New(t)
+	h, _ := splitHeadBody("---\nid: x\nrestart: on-failure\nkind: task\nbackoff:\n  min: 2s\n  max: 1m\n---\n")
+	fm := FrontMatter{}
+	assert.Nil(yaml.Unmarshal([]byte(h), &fm))
+	assert.Equal(RestartOnFailure, fm.Restart)
+	assert.Equal(KindTask, fm.Kind)
+	assert.Equal(2*time.Second, fm.Backoff.Min)
+	assert.Equal(time.Minute, fm.Backoff.Max)
+}
+
+func TestParseNeeds(t *testing.T) {
+	assert := assert.New(t)
+	fm := FrontMatter{}
+	assert.Nil(yaml.Unmarshal([]byte("needs: [db, setup:completed]"), &fm))
+	assert.Equal(Needs{{"db", NeedStarted}, {"setup", NeedCompleted}}, fm.Needs)
+
+	fm = FrontMatter{}
+	assert.Nil(yaml.Unmarshal([]byte("needs:\n  - id: db\n    condition: healthy"), &fm))
+	assert.Equal(Needs{{"db", NeedHealthy}}, fm.Needs)
+
+	fm = FrontMatter{}
+	assert.Nil(yaml.Unmarshal([]byte("needs: {db: healthy}"), &fm))
+	assert.Equal(Needs{{"db", NeedHealthy}}, fm.Needs)
+
+	fm = FrontMatter{}
+	assert.Nil(yaml.Unmarshal([]byte("needs: db"), &fm))
+	assert.Equal(Needs{{"db", NeedStarted}}, fm.Needs)
+
+	fm = FrontMatter{}
+	assert.Nil(yaml.Unmarshal([]byte("needs: db:healthy"), &fm))
+	assert.Equal(Needs{{"db", NeedHealthy}}, fm.Needs)
+
+	f := CodeFile{FrontMatter: FrontMatter{ID: "x", Needs: Needs{{"db", "ready"}}}}
+	assert.NotNil(validNeeds(f))
+	f.Needs = Needs{{"x", NeedStarted}}
+	assert.NotNil(validNeeds(f))
+}
+
+func TestSortRecipes(t *testing.T) {
+	assert := assert.New(t)
+	recipe := func(id string, needs ...string) CodeFile {
+		f := CodeFile{Path: id + ".md"}
+		f.ID = id
+		for _, n := range needs {
+			f.Needs = append(f.Needs, Need{n, NeedStarted})
+		}
+		return f
+	}
+
+	files, err := SortRecipes([]CodeFile{recipe("a", "c"), recipe("b"), recipe("c", "b")})
+	assert.Nil(err)
+	ids := []string{}
+	for _, f := range files {
+		ids = append(ids, f.ID)
+	}
+	assert.Equal([]string{"b", "c", "a"}, ids)
+
+	_, err = SortRecipes([]CodeFile{recipe("a", "x")})
+	assert.Equal("recipe 'a' needs unknown recipe 'x'", err.Error())
+
+	_, err = SortRecipes([]CodeFile{recipe("a", "b"), recipe("b", "c"), recipe("c", "a")})
+	assert.Equal("dependency cycle: a -> b -> c -> a", err.Error())
+
+	// Only the recipes with missing needs, and their dependents, are dropped
+	kept, dropped := DropUnresolved([]CodeFile{recipe("a", "b"), recipe("b", "x"), recipe("c"), recipe("d", "c")})
+	assert.Equal(2, len(kept))
+	assert.Equal("c", kept[0].ID)
+	assert.Equal("d", kept[1].ID)
+	assert.Equal("recipe 'b' needs unknown recipe 'x'", dropped["b.md"].Error())
+	assert.Equal("recipe 'a' needs recipe 'b', that was dropped", dropped["a.md"].Error())
+	// The cycles are not dropped
+	kept, dropped = DropUnresolved([]CodeFile{recipe("a", "b"), recipe("b", "a")})
+	assert.Equal(2, len(kept))
+	assert.Equal(0, len(dropped))
+
+	// The duplicate IDs are skipped; only the recipes that need them are dropped
+	dup := recipe("a")
+	dup.Path = "z.md"
+	kept, dropped = DropUnresolved([]CodeFile{dup, recipe("a"), recipe("b"), recipe("c", "a"), recipe("d", "c")})
+	assert.Equal(2, len(kept))
+	assert.Equal("a.md", kept[0].Path)
+	assert.Equal("b", kept[1].ID)
+	assert.Equal("duplicate recipe ID 'a', already used by 'a.md'", dropped["z.md"].Error())
+	assert.Equal("recipe 'c' needs recipe 'a', that is ambiguous: a.md, z.md", dropped["c.md"].Error())
+	assert.Equal("recipe 'd' needs recipe 'c', that was dropped", dropped["d.md"].Error())
+	files, err = SortRecipes([]CodeFile{dup, recipe("b", "c"), recipe("a"), recipe("c")})
+	assert.Nil(err)
+	paths := []string{}
+	for _, f := range files {
+		paths = append(paths, f.Path)
+	}
+	assert.Equal([]string{"a.md", "c.md", "b.md", "z.md"}, paths)
+	_, err = SortRecipes([]CodeFile{dup, recipe("a"), recipe("b", "a")})
+	assert.Equal("recipe 'b' needs recipe 'a', that is ambiguous: a.md, z.md", err.Error())
+}
+
+func TestParseHealth(t *testing.T) {
+	assert := assert.New(t)
+	h, _ := splitHeadBody("---\nid: x\nhealth:\n  http: :8080/health\n  kv:\n    key: beat\n    within: 30s\n  restart: true\n---\n")
+	fm := FrontMatter{}
+	assert.Nil(yaml.Unmarshal([]byte(h), &fm))
+	assert.Nil(validHealth(fm.Health))
+	assert.Equal("http://localhost:8080/health", fm.Health.HTTPAddr())
+	assert.Equal("beat", fm.Health.KV.Key)
+	assert.Equal(30*time.Second, fm.Health.KV.Within)
+	assert.True(fm.Health.Restart)
+
+	// Defaults
+	assert.Equal(10*time.Second, fm.Health.Every())
+	assert.Equal(2*time.Second, fm.Health.TimeLimit())
+	assert.Equal(uint(3), fm.Health.MaxFailures())
+
+	hc := &Health{TCP: "5432", Interval: time.Second, Timeout: time.Minute}
+	assert.Equal("localhost:5432", hc.TCPAddr())
+	assert.Equal(time.Second, hc.TimeLimit())
+
+	assert.NotNil(validHealth(&Health{Interval: time.Second}))
+	assert.NotNil(validHealth(&Health{KV: &KVHealth{Key: "beat"}}))
+}
+
+func TestClientCode(t *testing.T) {
+	assert := assert.New(t)
+	front := FrontMatter{ID: "x"}
+	for _, lang := range []string{"js", "mjs", "py"} {
+		assert.Contains(codeLangHeader(front, lang), "spinal = {")
+		assert.Contains(codeLangImports(front, lang), "SPIN_API")
+	}
+	assert.Contains(codeLangImports(front, "js"), "spinal.kv = {")
+	assert.Contains(codeLangImports(front, "mjs"), "import spinalHttp from 'http';")
+	assert.Contains(codeLangImports(front, "py"), "spinal = _Spinal(spinal)")
+	assert.Equal("", clientCode("go"))
+}
+
+func TestClientLog(t *testing.T) {
+	assert := assert.New(t)
+	posted := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posted <- r.Method + " " + r.URL.Path + " " + r.URL.Query().Get("lvl") + " " + r.URL.Query().Get("msg")
+		w.Write([]byte("OK"))
+	}))
+	defer srv.Close()
+
+	scripts := map[string][]string{
+		"bash":    {"-c", shClient + "\nspinal_log_info hello world\nspinal_log_error bad news"},
+		"python3": {"-c", "spinal = {}\n" + pyClient + "\nspinal.log.info('hello', 'world')\nspinal.log.error('bad news')"},
+		"node": {"-e", "const spinal = {};\n" + clientCode("js") +
+			"\nspinal.log.info('hello', 'world').then(() => spinal.log.error('bad news'))"},
+	}
+	for interp, args := range scripts {
+		if _, err := exec.LookPath(interp); err != nil {
+			t.Logf("Skipping the %s client: %v", interp, err)
+			continue
+		}
+		// With the API, the lines are posted into the log of the proc
+		cmd := exec.Command(interp, args...)
+		cmd.Env = append(os.Environ(), "SPIN_API="+srv.URL, "SPIN_ID=x", "SPIN_LOG=x.web")
+		out, err := cmd.CombinedOutput()
+		assert.Nil(err, string(out))
+		assert.Equal("", string(out), interp)
+		assert.Equal(2, len(posted), interp)
+		for len(posted) > 0 {
+			line := <-posted
+			assert.Contains([]string{"POST /log/x.web 30 hello world", "POST /log/x.web 50 bad news"}, line, interp)
+		}
+
+		// Without the API, the lines are printed
+		cmd = exec.Command(interp, args...)
+		cmd.Env = append(os.Environ(), "SPIN_API=", "SPIN_ID=x")
+		out, err = cmd.CombinedOutput()
+		assert.Nil(err, string(out))
+		assert.Contains(string(out), "hello world", interp)
+		assert.Contains(string(out), "bad news", interp)
+		assert.Equal(0, len(posted), interp)
+	}
+}
+
+func TestShellExports(t *testing.T) {
+	assert := assert.New(t)
+	front := FrontMatter{Enabled: true, ID: "x", DelayStart: 2, Env: []string{"A=1"},
+		Meta: map[string]interface{}{"servers": []interface{}{map[string]interface{}{"host": "it's"}}}}
+	assert.Equal(`export SPINAL_JSON='{"spinal":true,"id":"x","env":["A=1"],"delayStart":2,"meta":{"servers":[{"host":"it'\''s"}]}}'
+export SPINAL_DELAYSTART='2'
+export SPINAL_ENV_0='A=1'
+export SPINAL_ID='x'
+export SPINAL_META_SERVERS_0_HOST='it'\''s'
+export SPINAL_SPINAL='true'`, codeLangHeader(front, "sh"))
+	assert.Contains(codeLangImports(front, "zsh"), "spinal_kv_get() {")
+}
+
+func TestProcEnv(t *testing.T) {
+	assert := assert.New(t)
+	t.Setenv("SPIN_TEST_PARENT", "parent")
+
+	fm := FrontMatter{}
+	assert.Nil(yaml.Unmarshal([]byte("env:\n  - A=1\n  - B=${A}2\n"), &fm))
+	assert.Equal(EnvVars{"A=1", "B=${A}2"}, fm.Env)
+	assert.Nil(yaml.Unmarshal([]byte("env:\n  Z: 1\n  A: x\n"), &fm))
+	assert.Equal(EnvVars{"Z=1", "A=x"}, fm.Env)
+	assert.NotNil(yaml.Unmarshal([]byte("env: A=1"), &fm))
+
+	dir := t.TempDir()
+	envFile := "# comment\nexport USER=\"Bob \\\"B\\\"\"\nLIT='$HOME'\nP=${SPIN_TEST_PARENT}/x # note\n"
+	assert.Nil(ioutil.WriteFile(filepath.Join(dir, "app.env"), []byte(envFile), 0644))
+	fm = FrontMatter{
+		EnvFile:  "app.env",
+		CleanEnv: true,
+		Env:      EnvVars{"HELLO=hi ${USER}", "P=${P}/y", "SPIN_TEST_PARENT", "MISSING_FROM_PARENT"},
+	}
+	env, err := fm.ProcEnv(filepath.Join(dir, "recipe.md"))
+	assert.Nil(err)
+	assert.Equal([]string{
+		`USER=Bob "B"`, "LIT=$HOME", "P=parent/x/y", `HELLO=hi Bob "B"`, "SPIN_TEST_PARENT=parent",
+	}, env)
+
+	// Without clean_env, the parent environment comes first
+	fm = FrontMatter{Env: EnvVars{"SPIN_TEST_PARENT=child"}}
+	env, _ = fm.ProcEnv("recipe.md")
+	assert.Equal("SPIN_TEST_PARENT=child", env[len(env)-1])
+	assert.True(len(env) > 1)
+
+	// The key of the secrets is never passed to the procs
+	t.Setenv(secrets.KeyEnv, "key")
+	fm = FrontMatter{Env: EnvVars{secrets.KeyEnv, "K=${" + secrets.KeyEnv + "}"}}
+	env, err = fm.ProcEnv("recipe.md")
+	assert.Nil(err)
+	assert.Contains(env, "K=")
+	for _, kv := range env {
+		assert.False(strings.HasPrefix(kv, secrets.KeyEnv+"="))
+	}
+	cmd := exec.Command("sh", "-c", "echo \"${"+secrets.KeyEnv+"-unset}\"")
+	cmd.Env = env
+	out, err := cmd.Output()
+	assert.Nil(err)
+	assert.Equal("unset\n", string(out))
+
+	fm = FrontMatter{EnvFile: "missing.env"}
+	_, err = fm.ProcEnv(filepath.Join(dir, "recipe.md"))
+	assert.NotNil(err)
+	fm = FrontMatter{Env: EnvVars{"=x"}}
+	_, err = fm.ProcEnv("recipe.md")
+	assert.NotNil(err)
+}
+
+func TestParseLimits(t *testing.T) {
+	assert := assert.New(t)
+	for text, size := range map[string]Size{
+		"1024": 1024, "512M": 512 << 20, "1.5GiB": 3 << 29, "64kb": 64 << 10, "2 G": 2 << 30,
+	} {
+		s, err := ParseSize(text)
+		assert.Nil(err, text)
+		assert.Equal(size, s, text)
+	}
+	for _, text := range []string{"", "M", "-1K", "12X"} {
+		_, err := ParseSize(text)
+		assert.NotNil(err, text)
+	}
+
+	fm := FrontMatter{}
+	front := "limits:\n  memory: 256M\n  cpu: 0.5\n  files: 64\n  procs: 10\n  timeout: 1m30s\n"
+	assert.Nil(yaml.Unmarshal([]byte(front), &fm))
+	assert.Equal(&Limits{Memory: 256 << 20, CPU: 0.5, Files: 64, Procs: 10, Timeout: 90 * time.Second}, fm.Limits)
+	assert.False(fm.Limits.IsEmpty())
+	assert.Nil(validLimits(fm.Limits))
+	assert.NotNil(yaml.Unmarshal([]byte("limits:\n  memory: lots\n"), &fm))
+
+	assert.True((*Limits)(nil).IsEmpty())
+	assert.True((&Limits{}).IsEmpty())
+	assert.NotNil(validLimits(&Limits{Memory: 1000}))
+	assert.NotNil(validLimits(&Limits{CPU: 0.001}))
+	assert.NotNil(validLimits(&Limits{Timeout: -time.Second}))
+}
@@ -1,6 +1,7 @@
 package parser
 
 import (
+	"math"
 	"time"
 )
 
@@ -13,22 +14,29 @@ const (
 // StringToString is a helper map
 type StringToString map[string]string
 
-type CodeType struct {
-	Name       string
-	Executable string
-	Comment    string
-}
+// Overlap policies, for scheduled recipes that are still running
+// when the next tick comes
+const (
+	OverlapSkip  = "skip"          // ignore the tick (default)
+	OverlapQueue = "queue"         // run again after the current run
+	OverlapKill  = "kill-previous" // stop the current run and start again
+)
 
-// All known code block types
-var CodeBlocks = map[string]CodeType{
-	"js":  {"Javascript", "node", "//"}, // CommonJS
-	"mjs": {"Javascript", "node", "//"}, // ES Modules
-	"py":  {"Python", "python3", "#"},
-	"sh":  {"Bash", "bash", "#"},
-	"zsh": {"ZSH", "zsh", "#"},
-	// "go": {"Go", "go", "//"},
-	// "rb": {"Ruby", "ruby", "#"},
-}
+// Kinds of procs
+const (
+	KindTask    = "task"    // expected to finish; exit 0 means completed
+	KindService = "service" // expected to run until stopped
+)
+
+// Restart policies, applied when a proc exits
+const (
+	RestartNever     = "never"
+	RestartOnFailure = "on-failure"
+	RestartAlways    = "always"
+)
+
+// The delays between restarts, when the backoff is not defined
+var defaultBackoff = Backoff{Min: time.Second, Max: time.Minute, Factor: 2}
 
 // MetaData is a general object
 type MetaData interface{}
@@ -39,18 +47,112 @@ type FrontMatter struct {
 	Db         bool     `yaml:"db,omitempty"  json:"db,omitempty"`
 	Log        bool     `yaml:"log,omitempty" json:"log,omitempty"`
 	Cwd        string   `yaml:"cwd,omitempty" json:"cwd,omitempty"`
-	Env        []string `yaml:"env,omitempty" json:"env,omitempty"`
+	Env        EnvVars  `yaml:"env,omitempty" json:"env,omitempty"`
+	EnvFile    string   `yaml:"env_file,omitempty" json:"env_file,omitempty"`
+	CleanEnv   bool     `yaml:"clean_env,omitempty" json:"clean_env,omitempty"`
+	Secrets    []string `yaml:"secrets,omitempty" json:"secrets,omitempty"`
 	DelayStart uint     `yaml:"delayStart,omitempty" json:"delayStart,omitempty"`
 	RetryTimes uint     `yaml:"retryTimes,omitempty" json:"retryTimes,omitempty"`
+	Schedule   string   `yaml:"schedule,omitempty" json:"schedule,omitempty"`
+	Overlap    string   `yaml:"overlap,omitempty" json:"overlap,omitempty"`
+	Kind       string   `yaml:"kind,omitempty" json:"kind,omitempty"`
+	Restart    string   `yaml:"restart,omitempty" json:"restart,omitempty"`
+	Backoff    *Backoff `yaml:"backoff,omitempty" json:"backoff,omitempty"`
+	Needs      Needs    `yaml:"needs,omitempty" json:"needs,omitempty"`
+	Health     *Health  `yaml:"health,omitempty" json:"health,omitempty"`
+	Limits     *Limits  `yaml:"limits,omitempty" json:"limits,omitempty"`
 	Meta       MetaData `yaml:"meta" json:"meta"`
 }
 
+// Backoff represents the delays between restarts: starting at Min,
+// multiplied by Factor after each restart, but never more than Max.
+type Backoff struct {
+	Min    time.Duration `yaml:"min,omitempty" json:"min,omitempty"`
+	Max    time.Duration `yaml:"max,omitempty" json:"max,omitempty"`
+	Factor float64       `yaml:"factor,omitempty" json:"factor,omitempty"`
+}
+
+// Duration returns the delay before a restart, by attempt, counted from 0:
+// Min for the first restart, then Min * Factor^attempt, capped at Max
+func (b *Backoff) Duration(attempt uint) time.Duration {
+	min, max, factor := defaultBackoff.Min, defaultBackoff.Max, defaultBackoff.Factor
+	if b != nil {
+		if b.Min > 0 {
+			min = b.Min
+		}
+		if b.Max > 0 {
+			max = b.Max
+		}
+		if b.Factor >= 1 {
+			factor = b.Factor
+		}
+	}
+	d := float64(min) * math.Pow(factor, float64(attempt))
+	if d > float64(max) {
+		return max
+	}
+	return time.Duration(d)
+}
+
+// RestartPolicy returns the effective restart policy.
+// Without a policy, the procs are restarted on failure only if retryTimes is set.
+func (f FrontMatter) RestartPolicy() string {
+	if f.Restart != "" {
+		return f.Restart
+	}
+	if f.RetryTimes > 0 {
+		return RestartOnFailure
+	}
+	return RestartNever
+}
+
+// ProcKind returns the effective kind of procs.
+// Without a kind, scheduled recipes are tasks, the rest are services.
+func (f FrontMatter) ProcKind() string {
+	if f.Kind != "" {
+		return f.Kind
+	}
+	if f.Schedule != "" {
+		return KindTask
+	}
+	return KindService
+}
+
+// CodeBlock represents all the code blocks of the same language and name
+type CodeBlock struct {
+	Lang string
+	Name string
+	Code string
+}
+
+// Key returns the identity of the block: the language, for unnamed blocks,
+// or the name and the language, for named blocks, eg: "collector.py".
+func (b CodeBlock) Key() string {
+	if b.Name == "" {
+		return b.Lang
+	}
+	return b.Name + "." + b.Lang
+}
+
+// FileExt returns the extension of the generated file,
+// eg: "py", or "collector.py" for named blocks.
+func (b CodeBlock) FileExt() string {
+	ext := CodeBlocks[b.Lang].Ext
+	if ext == "" {
+		ext = b.Lang
+	}
+	if b.Name == "" {
+		return ext
+	}
+	return b.Name + "." + ext
+}
+
 type CodeFile struct {
 	FrontMatter
 	Path   string
 	Ctime  time.Time
 	Mtime  time.Time
-	Blocks map[string]string
+	Blocks map[string]CodeBlock
 }
 
 // IsValid makes a validation check for ID and Path
@@ -1,10 +1,21 @@
 package parser
 
 import (
+	"io/ioutil"
 	"reflect"
 	"strings"
 )
 
+// writeIfChanged writes the text into the file, only if the content is different,
+// so the modification time of the file is kept when nothing changed.
+func writeIfChanged(fname string, text string) error {
+	old, err := ioutil.ReadFile(fname)
+	if err == nil && string(old) == text {
+		return nil
+	}
+	return ioutil.WriteFile(fname, []byte(text), 0644)
+}
+
 func containsListStr(s []string, e string) bool {
 	for _, a := range s {
 		if a == e {
@@ -0,0 +1,306 @@
+// Package schedule parses cron expressions, with seconds,
+// and calculates the next time when they should fire.
+//
+// Inspired from: https://github.com/robfig/cron
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule describes a job's duty cycle
+type Schedule interface {
+	// Next returns the next activation time, later than the given time.
+	// A zero time is returned if the schedule never fires.
+	Next(time.Time) time.Time
+}
+
+// Every represents a simple recurring duty cycle, eg: "@every 10s"
+type Every struct {
+	Interval time.Duration
+}
+
+// Next returns the next time this should be run, rounded to the second
+func (e Every) Next(t time.Time) time.Time {
+	return t.Add(e.Interval - time.Duration(t.Nanosecond()))
+}
+
+// Cron represents a cron expression, as bit sets for each field
+type Cron struct {
+	second, minute, hour, dom, month, dow uint64
+	// True when the day-of-month, or day-of-week fields are "*"
+	domStar, dowStar bool
+}
+
+type bounds struct {
+	min, max uint
+	names    map[string]uint
+}
+
+var (
+	seconds = bounds{0, 59, nil}
+	minutes = bounds{0, 59, nil}
+	hours   = bounds{0, 23, nil}
+	doms    = bounds{1, 31, nil}
+	months  = bounds{1, 12, map[string]uint{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	dows = bounds{0, 7, map[string]uint{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+// Predefined schedules
+var descriptors = map[string]string{
+	"@yearly":   "0 0 0 1 1 *",
+	"@annually": "0 0 0 1 1 *",
+	"@monthly":  "0 0 0 1 * *",
+	"@weekly":   "0 0 0 * * 0",
+	"@daily":    "0 0 0 * * *",
+	"@midnight": "0 0 0 * * *",
+	"@hourly":   "0 0 * * * *",
+}
+
+// Parse returns a new schedule, from a cron expression with 6 fields:
+// second, minute, hour, day of month, month, day of week;
+// or 5 fields, without seconds; or a descriptor, eg: "@daily", "@every 10s".
+func Parse(expr string) (Schedule, error) {
+	expr = strings.TrimSpace(expr)
+	if expr == "" {
+		return nil, errors.New("empty schedule")
+	}
+
+	if strings.HasPrefix(expr, "@every") {
+		d, err := time.ParseDuration(strings.TrimSpace(expr[len("@every"):]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule '%s': %v", expr, err)
+		}
+		if d < time.Second {
+			return nil, fmt.Errorf("invalid schedule '%s': interval must be at least 1s", expr)
+		}
+		return Every{d}, nil
+	}
+	if strings.HasPrefix(expr, "@") {
+		spec, ok := descriptors[expr]
+		if !ok {
+			return nil, fmt.Errorf("unknown schedule descriptor '%s'", expr)
+		}
+		expr = spec
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) == 5 {
+		fields = append([]string{"0"}, fields...)
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("invalid schedule '%s': expected 5 or 6 fields, found %d", expr, len(fields))
+	}
+
+	c := &Cron{}
+	var err error
+	parsers := []struct {
+		field string
+		bits  *uint64
+		b     bounds
+	}{
+		{fields[0], &c.second, seconds},
+		{fields[1], &c.minute, minutes},
+		{fields[2], &c.hour, hours},
+		{fields[3], &c.dom, doms},
+		{fields[4], &c.month, months},
+		{fields[5], &c.dow, dows},
+	}
+	for _, p := range parsers {
+		if *p.bits, err = parseField(p.field, p.b); err != nil {
+			return nil, fmt.Errorf("invalid schedule '%s': %v", expr, err)
+		}
+	}
+	// Sunday can be 0, or 7
+	if c.dow&(1<<7) > 0 {
+		c.dow |= 1
+	}
+	c.domStar = isStar(fields[3])
+	c.dowStar = isStar(fields[5])
+	return c, nil
+}
+
+func isStar(field string) bool {
+	return field == "*" || field == "?"
+}
+
+// parseField returns the bit set for a comma-separated list of ranges
+func parseField(field string, b bounds) (uint64, error) {
+	var bits uint64
+	for _, expr := range strings.Split(field, ",") {
+		r, err := parseRange(expr, b)
+		if err != nil {
+			return 0, err
+		}
+		bits |= r
+	}
+	return bits, nil
+}
+
+// parseRange returns the bit set for one range, eg:
+// "*", "5", "1-5", "*/10", "10-30/5", "mon-fri"
+func parseRange(expr string, b bounds) (uint64, error) {
+	var (
+		start, end uint
+		step       uint = 1
+		err        error
+	)
+	rangeAndStep := strings.Split(expr, "/")
+	lowAndHigh := strings.Split(rangeAndStep[0], "-")
+
+	if isStar(lowAndHigh[0]) {
+		if len(lowAndHigh) > 1 {
+			return 0, fmt.Errorf("invalid range '%s'", expr)
+		}
+		start, end = b.min, b.max
+	} else {
+		if start, err = parseValue(lowAndHigh[0], b); err != nil {
+			return 0, err
+		}
+		switch len(lowAndHigh) {
+		case 1:
+			end = start
+		case 2:
+			if end, err = parseValue(lowAndHigh[1], b); err != nil {
+				return 0, err
+			}
+		default:
+			return 0, fmt.Errorf("invalid range '%s'", expr)
+		}
+	}
+
+	switch len(rangeAndStep) {
+	case 1:
+	case 2:
+		n, err := strconv.ParseUint(rangeAndStep[1], 10, 8)
+		if err != nil || n == 0 {
+			return 0, fmt.Errorf("invalid step '%s'", expr)
+		}
+		step = uint(n)
+		// "5/10" means "5-max/10"
+		if len(lowAndHigh) == 1 && !isStar(lowAndHigh[0]) {
+			end = b.max
+		}
+	default:
+		return 0, fmt.Errorf("invalid step '%s'", expr)
+	}
+
+	if start > end {
+		return 0, fmt.Errorf("invalid range '%s': %d > %d", expr, start, end)
+	}
+
+	var bits uint64
+	for i := start; i <= end; i += step {
+		bits |= 1 << i
+	}
+	return bits, nil
+}
+
+// parseValue returns a number, or a name, within bounds
+func parseValue(expr string, b bounds) (uint, error) {
+	if n, ok := b.names[strings.ToLower(expr)]; ok {
+		return n, nil
+	}
+	n, err := strconv.ParseUint(expr, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value '%s'", expr)
+	}
+	if uint(n) < b.min || uint(n) > b.max {
+		return 0, fmt.Errorf("value '%s' out of range [%d, %d]", expr, b.min, b.max)
+	}
+	return uint(n), nil
+}
+
+// Next returns the next time this schedule is activated, later than the given time.
+// If no time can be found to satisfy the schedule, the zero time is returned.
+func (c *Cron) Next(t time.Time) time.Time {
+	loc := t.Location()
+	// Start at the earliest possible time (the upcoming second)
+	t = t.Add(time.Second - time.Duration(t.Nanosecond()))
+	// If no time is found within five years, return zero
+	yearLimit := t.Year() + 5
+	// When a field is incremented, the lower fields must be reset
+	added := false
+
+WRAP:
+	if t.Year() > yearLimit {
+		return time.Time{}
+	}
+
+	for 1<<uint(t.Month())&c.month == 0 {
+		if !added {
+			added = true
+			t = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc)
+		}
+		t = t.AddDate(0, 1, 0)
+		if t.Month() == time.January {
+			goto WRAP
+		}
+	}
+
+	for !c.dayMatches(t) {
+		if !added {
+			added = true
+			t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+		}
+		t = t.AddDate(0, 0, 1)
+		if t.Day() == 1 {
+			goto WRAP
+		}
+	}
+
+	for 1<<uint(t.Hour())&c.hour == 0 {
+		if !added {
+			added = true
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, loc)
+		}
+		t = t.Add(time.Hour)
+		if t.Hour() == 0 {
+			goto WRAP
+		}
+	}
+
+	for 1<<uint(t.Minute())&c.minute == 0 {
+		if !added {
+			added = true
+			t = t.Truncate(time.Minute)
+		}
+		t = t.Add(time.Minute)
+		if t.Minute() == 0 {
+			goto WRAP
+		}
+	}
+
+	for 1<<uint(t.Second())&c.second == 0 {
+		if !added {
+			added = true
+			t = t.Truncate(time.Second)
+		}
+		t = t.Add(time.Second)
+		if t.Second() == 0 {
+			goto WRAP
+		}
+	}
+
+	return t
+}
+
+// dayMatches returns true if the day-of-month and day-of-week restrictions
+// are satisfied; if both are restricted, it's enough for one to match.
+func (c *Cron) dayMatches(t time.Time) bool {
+	domMatch := 1<<uint(t.Day())&c.dom > 0
+	dowMatch := 1<<uint(t.Weekday())&c.dow > 0
+	if c.domStar || c.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
@@ -0,0 +1,57 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseErrors(t *testing.T) {
+	assert := assert.New(t)
+	for _, expr := range []string{
+		"", "* * *", "* * * * * * *", "60 * * * * *", "* * 24 * * *",
+		"* * * 0 * *", "* * * * 13 *", "*/0 * * * * *", "5-1 * * * * *",
+		"@every", "@every 10", "@every 10ms", "@sometimes", "x * * * * *",
+	} {
+		_, err := Parse(expr)
+		assert.NotNil(err, "expression '%s' should be invalid", expr)
+	}
+}
+
+func TestEvery(t *testing.T) {
+	assert := assert.New(t)
+	s, err := Parse("@every 10s")
+	assert.Nil(err)
+	now := time.Date(2020, 1, 1, 10, 0, 0, 500, time.UTC)
+	assert.Equal(time.Date(2020, 1, 1, 10, 0, 10, 0, time.UTC), s.Next(now))
+}
+
+func TestCronNext(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Date(2020, 1, 31, 23, 59, 58, 100, time.UTC) // Friday
+	for _, tc := range []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * * *", time.Date(2020, 1, 31, 23, 59, 59, 0, time.UTC)},
+		{"*/10 * * * * *", time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"30 * * * * *", time.Date(2020, 2, 1, 0, 0, 30, 0, time.UTC)},
+		{"*/5 * * * *", time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 12 * * mon-fri", time.Date(2020, 2, 3, 12, 0, 0, 0, time.UTC)},
+		{"0 0 0 29 feb *", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 0 1,15 * *", time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 15-45/15 9 * * *", time.Date(2020, 2, 1, 9, 15, 0, 0, time.UTC)},
+		{"0 0 0 * * 7", time.Date(2020, 2, 2, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)},
+		// Day of month OR day of week
+		{"0 0 0 13 * fri", time.Date(2020, 2, 7, 0, 0, 0, 0, time.UTC)},
+		// Never fires
+		{"0 0 0 30 2 *", time.Time{}},
+	} {
+		s, err := Parse(tc.expr)
+		assert.Nil(err, "expression '%s' should be valid", tc.expr)
+		assert.Equal(tc.next, s.Next(now), "expression '%s'", tc.expr)
+	}
+}
@@ -0,0 +1,67 @@
+package secrets
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Redacted replaces the values of the secrets
+const Redacted = "[redacted]"
+
+// The shorter values are not redacted, they would hide too much
+const minRedactLen = 4
+
+var (
+	known    = map[string]bool{}
+	replacer = strings.NewReplacer()
+	redactMu sync.RWMutex
+)
+
+// Register adds the values that must be redacted,
+// as they are, and escaped in JSON
+func Register(values ...string) {
+	redactMu.Lock()
+	defer redactMu.Unlock()
+	changed := false
+	for _, v := range values {
+		if len(v) < minRedactLen {
+			continue
+		}
+		text, _ := json.Marshal(v)
+		for _, form := range []string{v, string(text[1 : len(text)-1])} {
+			if !known[form] {
+				known[form] = true
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return
+	}
+
+	// The longest values are replaced first
+	list := []string{}
+	for v := range known {
+		list = append(list, v)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return len(list[i]) > len(list[j])
+	})
+	pairs := []string{}
+	for _, v := range list {
+		pairs = append(pairs, v, Redacted)
+	}
+	replacer = strings.NewReplacer(pairs...)
+}
+
+// Redact replaces the values of the registered secrets
+func Redact(text string) string {
+	redactMu.RLock()
+	defer redactMu.RUnlock()
+	if len(known) == 0 {
+		return text
+	}
+	return replacer.Replace(text)
+}
@@ -0,0 +1,189 @@
+// Package secrets is a local store of secrets, encrypted with AES-GCM,
+// with a key derived with scrypt from a passphrase.
+// The passphrase comes from the SPIN_SECRET_KEY env var, or from a key file.
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// KeyEnv is the env var with the passphrase of the secrets
+const KeyEnv = "SPIN_SECRET_KEY"
+
+// The version of the file format
+const fileVersion = 1
+
+// ErrNoKey is returned when the passphrase is not defined
+var ErrNoKey = errors.New("the secrets key is not defined; set " + KeyEnv +
+	", or secrets_key_file in the config")
+
+// The secret names are used as env var names
+var reName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// sealed is the encrypted file
+type sealed struct {
+	Version int    `json:"version"`
+	Salt    []byte `json:"salt"`
+	Nonce   []byte `json:"nonce"`
+	Data    []byte `json:"data"`
+}
+
+// Store is a map of secrets, by name, loaded from an encrypted file.
+// The changes are written only on Save.
+type Store struct {
+	path       string
+	passphrase []byte
+	values     map[string]string
+}
+
+// ValidName returns an error if the name cannot be used as a secret
+func ValidName(name string) error {
+	if !reName.MatchString(name) {
+		return fmt.Errorf("invalid secret name '%s': must be a valid env var name", name)
+	}
+	return nil
+}
+
+// Open loads the secrets from the file, if it exists.
+// The passphrase is read from the env var, or from the key file.
+func Open(fname string, keyFile string) (*Store, error) {
+	passphrase, err := readKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{path: fname, passphrase: passphrase, values: map[string]string{}}
+
+	data, err := os.ReadFile(fname)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	file := sealed{}
+	if err := json.Unmarshal(data, &file); err != nil || file.Version != fileVersion {
+		return nil, fmt.Errorf("invalid secrets file '%s'", fname)
+	}
+	gcm, err := newCipher(passphrase, file.Salt)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := gcm.Open(nil, file.Nonce, file.Data, nil)
+	if err != nil {
+		return nil, errors.New("cannot decrypt the secrets: wrong key, or corrupted file")
+	}
+	if err := json.Unmarshal(plain, &s.values); err != nil {
+		return nil, fmt.Errorf("invalid secrets file '%s'", fname)
+	}
+	return s, nil
+}
+
+// Get returns the value of a secret
+func (s *Store) Get(name string) (string, bool) {
+	value, ok := s.values[name]
+	return value, ok
+}
+
+// Set adds, or replaces a secret
+func (s *Store) Set(name, value string) error {
+	if err := ValidName(name); err != nil {
+		return err
+	}
+	s.values[name] = value
+	return nil
+}
+
+// Remove deletes a secret; returns false if it doesn't exist
+func (s *Store) Remove(name string) bool {
+	_, ok := s.values[name]
+	delete(s.values, name)
+	return ok
+}
+
+// Names returns the names of the secrets, sorted
+func (s *Store) Names() []string {
+	names := []string{}
+	for name := range s.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Save encrypts the secrets with a new salt and nonce,
+// and writes the file atomically, readable only by the owner
+func (s *Store) Save() error {
+	plain, err := json.Marshal(s.values)
+	if err != nil {
+		return err
+	}
+	file := sealed{Version: fileVersion, Salt: make([]byte, 16)}
+	if _, err := rand.Read(file.Salt); err != nil {
+		return err
+	}
+	gcm, err := newCipher(s.passphrase, file.Salt)
+	if err != nil {
+		return err
+	}
+	file.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(file.Nonce); err != nil {
+		return err
+	}
+	file.Data = gcm.Seal(nil, file.Nonce, plain, nil)
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// readKey returns the passphrase from the env var, or from the key file
+func readKey(keyFile string) ([]byte, error) {
+	if key := os.Getenv(KeyEnv); key != "" {
+		return []byte(key), nil
+	}
+	if keyFile == "" {
+		return nil, ErrNoKey
+	}
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the secrets key file: %v", err)
+	}
+	key := strings.TrimSpace(string(data))
+	if key == "" {
+		return nil, ErrNoKey
+	}
+	return []byte(key), nil
+}
+
+// newCipher derives the AES key from the passphrase and the salt
+func newCipher(passphrase, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
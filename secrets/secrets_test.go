@@ -0,0 +1,63 @@
+package secrets
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "dbs", "secrets.enc")
+
+	t.Setenv(KeyEnv, "")
+	_, err := Open(fname, "")
+	assert.Equal(ErrNoKey, err)
+
+	t.Setenv(KeyEnv, "correct horse")
+	s, err := Open(fname, "")
+	assert.Nil(err)
+	assert.Equal([]string{}, s.Names())
+	assert.Nil(s.Set("DB_PASSWORD", "hunter2"))
+	assert.Nil(s.Set("TOKEN", "abc"))
+	assert.NotNil(s.Set("not-valid", "x"))
+	assert.Nil(s.Save())
+
+	data, err := os.ReadFile(fname)
+	assert.Nil(err)
+	assert.NotContains(string(data), "hunter2")
+	info, _ := os.Stat(fname)
+	assert.Equal(os.FileMode(0600), info.Mode().Perm())
+
+	s, err = Open(fname, "")
+	assert.Nil(err)
+	assert.Equal([]string{"DB_PASSWORD", "TOKEN"}, s.Names())
+	v, ok := s.Get("DB_PASSWORD")
+	assert.True(ok)
+	assert.Equal("hunter2", v)
+	assert.True(s.Remove("TOKEN"))
+	assert.False(s.Remove("TOKEN"))
+
+	// The key file is used without the env var
+	t.Setenv(KeyEnv, "")
+	keyFile := filepath.Join(dir, "secrets.key")
+	assert.Nil(os.WriteFile(keyFile, []byte("wrong\n"), 0600))
+	_, err = Open(fname, keyFile)
+	assert.NotNil(err)
+	assert.Nil(os.WriteFile(keyFile, []byte("correct horse\n"), 0600))
+	_, err = Open(fname, keyFile)
+	assert.Nil(err)
+}
+
+func TestRedact(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("no secrets", Redact("no secrets"))
+
+	Register("abc", `pa"ss`, "hunter2", "hunter22")
+	assert.Equal("abc [redacted] and [redacted]", Redact("abc hunter22 and hunter2"))
+	assert.Equal(`{"msg":"[redacted]"}`, Redact(`{"msg":"pa\"ss"}`))
+	assert.Equal("[redacted]", Redact(`pa"ss`))
+}
@@ -0,0 +1,109 @@
+package state
+
+import (
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	EventRecipeAdded    = "recipe.added"
+	EventRecipeReloaded = "recipe.reloaded"
+	EventRecipeRemoved  = "recipe.removed"
+	EventProcState      = "proc.state"  // a proc changed its state
+	EventProcResult     = "proc.result" // a proc run ended
+	EventHealth         = "health"      // a recipe changed its health status
+)
+
+// How many events can wait for a slow subscriber, before they are dropped
+const eventBuffer = 100
+
+// Event is a change in the StateTree
+type Event struct {
+	Type   string      `json:"type"`
+	Recipe string      `json:"recipe"`         // the recipe path (lvl1 name)
+	ID     string      `json:"id,omitempty"`   // the recipe ID
+	Proc   string      `json:"proc,omitempty"` // the proc ID (lvl2 name)
+	State  string      `json:"state,omitempty"`
+	Time   time.Time   `json:"time"`
+	Data   interface{} `json:"data,omitempty"` // the recipe, proc, or health info
+}
+
+// EventFilter selects the events by recipe (path or ID), and by type.
+// Empty lists select everything.
+type EventFilter struct {
+	Recipes []string
+	Types   []string
+}
+
+// Match returns true if the event is selected
+func (f EventFilter) Match(e Event) bool {
+	return (len(f.Recipes) == 0 || contains(f.Recipes, e.Recipe) || contains(f.Recipes, e.ID)) &&
+		(len(f.Types) == 0 || contains(f.Types, e.Type))
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s && s != "" {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	subscribers = map[chan Event]bool{}
+	subsLock    sync.RWMutex
+)
+
+// Subscribe returns a channel that receives all the events,
+// and a function to unsubscribe. The events are dropped
+// when the subscriber is too slow.
+func Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, eventBuffer)
+	subsLock.Lock()
+	subscribers[ch] = true
+	subsLock.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			subsLock.Lock()
+			delete(subscribers, ch)
+			subsLock.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// Publish sends an event to all the subscribers, without blocking
+func Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	subsLock.RLock()
+	defer subsLock.RUnlock()
+	for ch := range subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// PublishRecipe sends an event about a recipe, with the recipe snapshot
+func PublishRecipe(eventType string, name string, id string) {
+	e := Event{Type: eventType, Recipe: name, ID: id}
+	if r, exists := GetRecipe(name); exists {
+		e.Data = r
+	}
+	Publish(e)
+}
+
+// recipeID returns the ID of a recipe, if it exists
+func recipeID(name string) string {
+	if l, exists := state.Load(name); exists {
+		return l.(Header1).ID
+	}
+	return ""
+}
@@ -0,0 +1,131 @@
+package state
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// Counts the changes of the StateTree, to save it only when changed
+var changes uint64
+
+func touch() {
+	atomic.AddUint64(&changes, 1)
+}
+
+// Save writes a snapshot of the StateTree as JSON, atomically:
+// the file is written next to the destination, then renamed.
+func Save(fname string) error {
+	data, err := json.MarshalIndent(Snapshot(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(fname), filepath.Base(fname)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fname)
+}
+
+// Load reads a StateTree snapshot, saved before
+func Load(fname string) (Tree, error) {
+	tree := Tree{}
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return tree, err
+	}
+	err = json.Unmarshal(data, &tree)
+	return tree, err
+}
+
+// Persist saves the StateTree at every interval, if it changed.
+// The returned function stops saving, after a final save.
+func Persist(fname string, interval time.Duration, onError func(error)) func() {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	var saved uint64
+	save := func() {
+		current := atomic.LoadUint64(&changes)
+		if current == saved {
+			return
+		}
+		if err := Save(fname); err != nil {
+			onError(err)
+			return
+		}
+		saved = current
+	}
+
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				save()
+				return
+			case <-ticker.C:
+				save()
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+// Restore copies the history of a recipe from a previous snapshot:
+// the restarts, the schedule runs and the last health failure
+func (h *Header1) Restore(prev Recipe) {
+	h.Restarts = prev.Restarts
+	if h.Schedule != nil && prev.Schedule != nil {
+		h.Schedule.LastRun = prev.Schedule.LastRun
+		h.Schedule.Runs = prev.Schedule.Runs
+		h.Schedule.Skipped = prev.Schedule.Skipped
+	}
+	if h.Health != nil && prev.Health != nil {
+		h.Health.LastFailure = prev.Health.LastFailure
+		h.Health.LastFailureAt = prev.Health.LastFailureAt
+	}
+}
+
+// Restore copies the history of a proc from a previous snapshot:
+// the restarts, the result, the last exit and the limit kills
+func (h *Header2) Restore(prev Header2) {
+	h.Restarts = prev.Restarts
+	h.Result = prev.Result
+	h.LastExit = prev.LastExit
+	if h.Limits != nil && prev.Limits != nil {
+		h.Limits.Kills = prev.Limits.Kills
+	}
+}
+
+// FindProc returns a proc of the recipe, by ID
+func (r Recipe) FindProc(id string) (Header2, bool) {
+	for _, p := range r.Procs {
+		if p.ID == id {
+			return p, true
+		}
+	}
+	return Header2{}, false
+}
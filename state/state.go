@@ -1,6 +1,7 @@
 package state
 
 import (
+	"strings"
 	"sync"
 	"time"
 
@@ -12,26 +13,128 @@ const separator = "∷"
 // There is only 1 state tree and cannot be changed
 var state sync.Map
 
+// Used when a state is read and changed
+var lock sync.Mutex
+
 // Header1 represents Level1 properties
 type Header1 struct {
-	Enabled bool      `json:"enabled"`
-	ID      string    `json:"id"`
-	Db      bool      `json:"db,omitempty"`
-	Log     bool      `json:"log,omitempty"`
-	Cwd     string    `json:"cwd,omitempty"`
-	Path    string    `json:"path"`
-	Ctime   time.Time `json:"ctime"`
-	Mtime   time.Time `json:"mtime"`
+	Enabled  bool      `json:"enabled"`
+	ID       string    `json:"id"`
+	Db       bool      `json:"db,omitempty"`
+	Log      bool      `json:"log,omitempty"`
+	Cwd      string    `json:"cwd,omitempty"`
+	Path     string    `json:"path"`
+	Ctime    time.Time `json:"ctime"`
+	Mtime    time.Time `json:"mtime"`
+	Kind     string    `json:"kind"`
+	Restart  string    `json:"restart"`  // the effective restart policy
+	Restarts uint      `json:"restarts"` // for all the procs
+	// Errors that stopped the procs from starting, eg: build failures
+	Errors map[string]string `json:"errors,omitempty"`
+	// Only for scheduled recipes
+	Schedule *ScheduleInfo `json:"schedule,omitempty"`
+	// Only for recipes with health checks
+	Health *HealthInfo `json:"health,omitempty"`
+}
+
+// ScheduleInfo represents the runs of a scheduled recipe
+type ScheduleInfo struct {
+	Expr    string    `json:"expr"`
+	Overlap string    `json:"overlap"`
+	LastRun time.Time `json:"lastRun"`
+	NextRun time.Time `json:"nextRun"`
+	Runs    uint      `json:"runs"`
+	Skipped uint      `json:"skipped"`
+}
+
+// HealthInfo represents the health checks of a recipe
+type HealthInfo struct {
+	Status        string    `json:"status"`
+	Failures      uint      `json:"failures"` // consecutive failures
+	LastCheck     time.Time `json:"lastCheck"`
+	LastFailure   string    `json:"lastFailure,omitempty"`
+	LastFailureAt time.Time `json:"lastFailureAt"`
+}
+
+// Health states
+const (
+	HealthUnknown   = "unknown"   // not checked yet
+	HealthOK        = "healthy"   // the last check passed
+	HealthFailing   = "failing"   // the last check failed, but not enough times
+	HealthUnhealthy = "unhealthy" // too many consecutive failures
+)
+
+// SetError records the error of one child, by block key
+func (h *Header1) SetError(key string, err error) {
+	if h.Errors == nil {
+		h.Errors = map[string]string{}
+	}
+	h.Errors[key] = err.Error()
+}
+
+// Header2 represents Level2 properties:
+// the Overseer process state, and the Spinal properties
+type Header2 struct {
+	ovr.ProcessJSON
+	Kind     string `json:"kind"`
+	Restart  string `json:"restart"` // the effective restart policy
+	Restarts uint   `json:"restarts"`
+	// The outcome of the last run: completed, failed, exited, stopped,
+	// unhealthy, limited, or restarting; empty while running
+	Result string `json:"result,omitempty"`
+	// How the last run ended
+	LastExit *ExitInfo `json:"lastExit,omitempty"`
+	// Only for procs with resource limits
+	Limits *LimitsInfo `json:"limits,omitempty"`
+}
+
+// ExitInfo represents the end of a proc run
+type ExitInfo struct {
+	Code  int       `json:"code"`
+	Error string    `json:"error,omitempty"`
+	Time  time.Time `json:"time"`
+	// The limit that killed the proc: timeout, or memory
+	Limit string `json:"limit,omitempty"`
+}
+
+// LimitsInfo represents the resource limits applied to a proc
+type LimitsInfo struct {
+	Memory  int64   `json:"memory,omitempty"` // bytes
+	CPU     float64 `json:"cpu,omitempty"`    // number of CPUs
+	Files   uint64  `json:"files,omitempty"`
+	Procs   uint64  `json:"procs,omitempty"`
+	Timeout string  `json:"timeout,omitempty"`
+	// The cgroup v2 folder; empty if only the rlimits are applied
+	Cgroup string `json:"cgroup,omitempty"`
+	// Why the cgroup couldn't be used
+	CgroupError string `json:"cgroupError,omitempty"`
+	// The limits that are not applied, without a cgroup, eg: memory, cpu
+	Unenforced []string `json:"unenforced,omitempty"`
+	// The runs killed by the limits
+	Kills uint `json:"kills"`
 }
 
-// Header2 represents Level2 properties
-type Header2 = ovr.ProcessJSON
+// Results of a process run
+const (
+	ResultCompleted  = "completed"  // a task that exited normally
+	ResultExited     = "exited"     // a service that exited normally
+	ResultFailed     = "failed"     // exited with error
+	ResultStopped    = "stopped"    // stopped, or interrupted
+	ResultUnhealthy  = "unhealthy"  // stopped by the health checks
+	ResultLimited    = "limited"    // killed by a resource limit
+	ResultRestarting = "restarting" // waiting to restart
+)
 
 // GetState returns a full copy of the state
 func GetState() sync.Map {
 	return state
 }
 
+// StateMap returns the live state, without copying it
+func StateMap() *sync.Map {
+	return &state
+}
+
 // HasLevel1 checks for a lvl1 name
 func HasLevel1(name string) (exists bool) {
 	_, exists = state.Load(name)
@@ -47,7 +150,48 @@ func GetLevel1(name string) Header1 {
 
 // SetLevel1 updates the StateTree
 func SetLevel1(name string, props *Header1) {
+	lock.Lock()
+	defer lock.Unlock()
 	state.Store(name, *props)
+	touch()
+}
+
+// UpdateLevel1 changes a lvl1 state in place, if it exists
+func UpdateLevel1(name string, update func(*Header1)) bool {
+	lock.Lock()
+	defer lock.Unlock()
+	l, exists := state.Load(name)
+	if !exists {
+		return false
+	}
+	h := l.(Header1)
+	// The schedule and health info are shared between copies
+	if h.Schedule != nil {
+		sch := *h.Schedule
+		h.Schedule = &sch
+	}
+	if h.Health != nil {
+		hlt := *h.Health
+		h.Health = &hlt
+	}
+	update(&h)
+	state.Store(name, h)
+	touch()
+	return true
+}
+
+// DelLevel1 removes a lvl1 state, together with all its children
+func DelLevel1(name string) {
+	lock.Lock()
+	defer lock.Unlock()
+	state.Delete(name)
+	state.Range(func(k, v interface{}) bool {
+		if strings.HasPrefix(k.(string), name+separator) {
+			state.Delete(k)
+		}
+		return true
+	})
+	touch()
 }
 
 // HasLevel2 checks for a lvl2 name
@@ -63,7 +207,64 @@ func GetLevel2(name1 string, name2 string) Header2 {
 	return l.(Header2)
 }
 
-// SetLevel2 updates the StateTree
-func SetLevel2(name1 string, name2 string, props *Header2) {
-	state.Store(name1+separator+name2, *props)
+// SetLevel2 updates the process state of a lvl2,
+// keeping the Spinal properties
+func SetLevel2(name1 string, name2 string, props *ovr.ProcessJSON) {
+	lock.Lock()
+	defer lock.Unlock()
+	setLevel2(name1, name2, props)
+}
+
+// SetLevel2IfExists updates the process state of a lvl2,
+// only if the lvl1 exists; the late process changes
+// must not re-create the recipes that were removed
+func SetLevel2IfExists(name1 string, name2 string, props *ovr.ProcessJSON) bool {
+	lock.Lock()
+	defer lock.Unlock()
+	if _, exists := state.Load(name1); !exists {
+		return false
+	}
+	setLevel2(name1, name2, props)
+	return true
+}
+
+func setLevel2(name1 string, name2 string, props *ovr.ProcessJSON) {
+	h := Header2{}
+	if l, exists := state.Load(name1 + separator + name2); exists {
+		h = l.(Header2)
+	}
+	changed := h.State != props.State
+	h.ProcessJSON = *props
+	// A new run resets the result of the previous run
+	if props.State == "starting" || props.State == "running" {
+		h.Result = ""
+	}
+	state.Store(name1+separator+name2, h)
+	touch()
+	if changed {
+		Publish(Event{
+			Type: EventProcState, Recipe: name1, ID: recipeID(name1),
+			Proc: name2, State: h.State, Data: h,
+		})
+	}
+}
+
+// UpdateLevel2 changes a lvl2 state in place, or creates it
+func UpdateLevel2(name1 string, name2 string, update func(*Header2)) {
+	lock.Lock()
+	defer lock.Unlock()
+	h := Header2{}
+	if l, exists := state.Load(name1 + separator + name2); exists {
+		h = l.(Header2)
+	}
+	result := h.Result
+	update(&h)
+	state.Store(name1+separator+name2, h)
+	touch()
+	if h.Result != result && h.Result != "" {
+		Publish(Event{
+			Type: EventProcResult, Recipe: name1, ID: recipeID(name1),
+			Proc: name2, State: h.Result, Data: h,
+		})
+	}
 }
@@ -1,9 +1,14 @@
 package state
 
 import (
+	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	ovr "github.com/ShinyTrinkets/overseer"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -39,7 +44,7 @@ func TestStateLvls(t *testing.T) {
 	assert.Equal("x/y/z", GetLevel1("x.md").Path)
 
 	SetLevel2("x.md", "x.js",
-		&Header2{
+		&ovr.ProcessJSON{
 			ID:  "x",
 			Cmd: "x.js",
 			Dir: ".",
@@ -51,4 +56,197 @@ func TestStateLvls(t *testing.T) {
 	assert.True(HasLevel2("x.md", "x.js"))
 	assert.Equal("x", GetLevel2("x.md", "x.js").ID)
 	assert.Equal(".", GetLevel2("x.md", "x.js").Dir)
+
+	DelLevel1("x.md")
+	assert.Equal(0, stateLength(StateMap()))
+	assert.False(HasLevel1("x.md"))
+	assert.False(HasLevel2("x.md", "x.js"))
+}
+
+func TestUpdateLevel1(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.False(UpdateLevel1("y.md", func(h *Header1) {}))
+
+	SetLevel1("y.md", &Header1{
+		ID: "y", Schedule: &ScheduleInfo{Expr: "@hourly"},
+		Health: &HealthInfo{Status: HealthUnknown},
+	})
+	old := GetLevel1("y.md")
+	assert.True(UpdateLevel1("y.md", func(h *Header1) {
+		h.Schedule.Runs++
+		h.Health.Status = HealthOK
+	}))
+	assert.Equal(uint(1), GetLevel1("y.md").Schedule.Runs)
+	assert.Equal(HealthOK, GetLevel1("y.md").Health.Status)
+	// The old copy is not changed
+	assert.Equal(uint(0), old.Schedule.Runs)
+	assert.Equal(HealthUnknown, old.Health.Status)
+
+	DelLevel1("y.md")
+}
+
+func TestUpdateLevel2(t *testing.T) {
+	assert := assert.New(t)
+
+	UpdateLevel2("z.md", "z.py", func(h *Header2) {
+		h.Restart = "always"
+		h.Restarts = 2
+		h.Result = ResultRestarting
+	})
+	assert.Equal("always", GetLevel2("z.md", "z.py").Restart)
+
+	// The process state doesn't overwrite the Spinal properties
+	SetLevel2("z.md", "z.py", &ovr.ProcessJSON{ID: "z.py", State: "running"})
+	h := GetLevel2("z.md", "z.py")
+	assert.Equal("running", h.State)
+	assert.Equal("always", h.Restart)
+	assert.Equal(uint(2), h.Restarts)
+	assert.Equal("", h.Result)
+
+	DelLevel1("z.md")
+	assert.False(HasLevel2("z.md", "z.py"))
+
+	// A late process change doesn't re-create a removed recipe
+	assert.False(SetLevel2IfExists("z.md", "z.py", &ovr.ProcessJSON{ID: "z.py", State: "finished"}))
+	assert.False(HasLevel2("z.md", "z.py"))
+	SetLevel1("z.md", &Header1{ID: "z"})
+	assert.True(SetLevel2IfExists("z.md", "z.py", &ovr.ProcessJSON{ID: "z.py", State: "running"}))
+	assert.Equal("running", GetLevel2("z.md", "z.py").State)
+	DelLevel1("z.md")
+}
+
+func TestSnapshot(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(0, len(Snapshot().Recipes))
+	_, exists := GetRecipe("b.md")
+	assert.False(exists)
+
+	SetLevel1("b.md", &Header1{ID: "b"})
+	SetLevel1("a.md", &Header1{ID: "a"})
+	SetLevel2("a.md", "a.py", &ovr.ProcessJSON{ID: "a.py", State: "running"})
+	SetLevel2("a.md", "a.js", &ovr.ProcessJSON{ID: "a.js"})
+
+	tree := Snapshot()
+	assert.Equal(2, len(tree.Recipes))
+	assert.Equal("a", tree.Recipes[0].ID)
+	assert.Equal("b", tree.Recipes[1].ID)
+	assert.Equal(0, len(tree.Recipes[1].Procs))
+
+	r, exists := GetRecipe("a.md")
+	assert.True(exists)
+	assert.Equal(2, len(r.Procs))
+	assert.Equal("a.js", r.Procs[0].ID)
+	assert.Equal("running", r.Procs[1].State)
+
+	children := []string{}
+	RangeLevel2("a.md", func(name string, h Header2) bool {
+		children = append(children, name)
+		return true
+	})
+	assert.ElementsMatch([]string{"a.js", "a.py"}, children)
+
+	DelLevel1("a.md")
+	DelLevel1("b.md")
+	assert.Equal(0, len(Snapshot().Recipes))
+}
+
+func TestSaveLoad(t *testing.T) {
+	assert := assert.New(t)
+	fname := filepath.Join(t.TempDir(), "dbs", "state.json")
+
+	SetLevel1("p.md", &Header1{ID: "p", Restarts: 2, Schedule: &ScheduleInfo{Runs: 5}})
+	UpdateLevel2("p.md", "p.sh", func(h *Header2) {
+		h.ID = "p.sh"
+		h.Restarts = 2
+		h.LastExit = &ExitInfo{Code: 1, Error: "boom"}
+	})
+	assert.Nil(Save(fname))
+	DelLevel1("p.md")
+
+	tree, err := Load(fname)
+	assert.Nil(err)
+	assert.Equal(1, len(tree.Recipes))
+	prev := tree.Recipes[0]
+
+	h1 := Header1{ID: "p", Schedule: &ScheduleInfo{}}
+	h1.Restore(prev)
+	assert.Equal(uint(2), h1.Restarts)
+	assert.Equal(uint(5), h1.Schedule.Runs)
+
+	p, exists := prev.FindProc("p.sh")
+	assert.True(exists)
+	h2 := Header2{}
+	h2.Restore(p)
+	assert.Equal(uint(2), h2.Restarts)
+	assert.Equal("boom", h2.LastExit.Error)
+
+	_, err = Load(fname + ".x")
+	assert.True(os.IsNotExist(err))
+}
+
+func TestPersist(t *testing.T) {
+	assert := assert.New(t)
+	fname := filepath.Join(t.TempDir(), "state.json")
+
+	stop := Persist(fname, time.Hour, func(err error) {
+		assert.Nil(err)
+	})
+	SetLevel1("q.md", &Header1{ID: "q"})
+	// The final save, on stop
+	stop()
+	tree, err := Load(fname)
+	assert.Nil(err)
+	assert.Equal("q", tree.Recipes[0].ID)
+
+	// Without changes, the file is not saved
+	os.Remove(fname)
+	atomic.StoreUint64(&changes, 0)
+	stop = Persist(fname, 10*time.Millisecond, func(err error) {})
+	time.Sleep(30 * time.Millisecond)
+	stop()
+	_, err = os.Stat(fname)
+	assert.True(os.IsNotExist(err))
+
+	DelLevel1("q.md")
+}
+
+func TestEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	events, unsubscribe := Subscribe()
+	SetLevel1("e.md", &Header1{ID: "e"})
+	SetLevel2("e.md", "e.sh", &ovr.ProcessJSON{ID: "e.sh", State: "running"})
+	// The same state is not published again
+	SetLevel2("e.md", "e.sh", &ovr.ProcessJSON{ID: "e.sh", State: "running", PID: 1})
+	UpdateLevel2("e.md", "e.sh", func(h *Header2) {
+		h.Result = ResultCompleted
+	})
+	PublishRecipe(EventRecipeRemoved, "e.md", "e")
+	unsubscribe()
+	unsubscribe()
+
+	received := []Event{}
+	for e := range events {
+		received = append(received, e)
+	}
+	assert.Equal(3, len(received))
+	assert.Equal(EventProcState, received[0].Type)
+	assert.Equal("e", received[0].ID)
+	assert.Equal("e.sh", received[0].Proc)
+	assert.Equal("running", received[0].State)
+	assert.Equal(EventProcResult, received[1].Type)
+	assert.Equal(ResultCompleted, received[1].State)
+	assert.Equal(EventRecipeRemoved, received[2].Type)
+	assert.False(received[2].Time.IsZero())
+
+	f := EventFilter{Recipes: []string{"e"}, Types: []string{EventProcState}}
+	assert.True(f.Match(received[0]))
+	assert.False(f.Match(received[1]))
+	f = EventFilter{Recipes: []string{"x.md"}}
+	assert.False(f.Match(received[0]))
+	assert.True(EventFilter{}.Match(received[2]))
+
+	DelLevel1("e.md")
 }
@@ -0,0 +1,77 @@
+package state
+
+import (
+	"sort"
+	"strings"
+)
+
+// Recipe is a snapshot of one recipe, with its procs
+type Recipe struct {
+	Header1
+	Procs []Header2 `json:"procs"`
+}
+
+// Tree is a snapshot of the whole StateTree
+type Tree struct {
+	Recipes []Recipe `json:"recipes"`
+}
+
+// RangeLevel1 calls the function for each recipe, in no particular order,
+// until the function returns false
+func RangeLevel1(fn func(name string, h Header1) bool) {
+	state.Range(func(k, v interface{}) bool {
+		if h, ok := v.(Header1); ok {
+			return fn(k.(string), h)
+		}
+		return true
+	})
+}
+
+// RangeLevel2 calls the function for each child of a recipe,
+// in no particular order, until the function returns false
+func RangeLevel2(name1 string, fn func(name2 string, h Header2) bool) {
+	prefix := name1 + separator
+	state.Range(func(k, v interface{}) bool {
+		key := k.(string)
+		if h, ok := v.(Header2); ok && strings.HasPrefix(key, prefix) {
+			return fn(key[len(prefix):], h)
+		}
+		return true
+	})
+}
+
+// GetRecipe returns a snapshot of one recipe, with its procs sorted by ID
+func GetRecipe(name string) (Recipe, bool) {
+	l, exists := state.Load(name)
+	if !exists {
+		return Recipe{}, false
+	}
+	r := Recipe{Header1: l.(Header1), Procs: []Header2{}}
+	RangeLevel2(name, func(_ string, h Header2) bool {
+		r.Procs = append(r.Procs, h)
+		return true
+	})
+	sort.Slice(r.Procs, func(i, j int) bool {
+		return r.Procs[i].ID < r.Procs[j].ID
+	})
+	return r, true
+}
+
+// Snapshot returns a copy of the StateTree, with the recipes sorted by name
+func Snapshot() Tree {
+	names := []string{}
+	RangeLevel1(func(name string, _ Header1) bool {
+		names = append(names, name)
+		return true
+	})
+	sort.Strings(names)
+
+	tree := Tree{Recipes: []Recipe{}}
+	for _, name := range names {
+		// The recipe might have been removed in the mean time
+		if r, exists := GetRecipe(name); exists {
+			tree.Recipes = append(tree.Recipes, r)
+		}
+	}
+	return tree
+}